@@ -0,0 +1,35 @@
+package sshproxy
+
+import (
+	"fmt"
+)
+
+// AuthMethod is an authentication method ContainerSSH can use against the backing server.
+type AuthMethod string
+
+// AuthMethod are the supported authentication methods.
+const (
+	// AuthMethodPublicKey offers the issued certificate and the configured private keys.
+	AuthMethodPublicKey AuthMethod = "publickey"
+	// AuthMethodPassword offers the configured password.
+	AuthMethodPassword AuthMethod = "password"
+	// AuthMethodKeyboardInteractive answers keyboard-interactive questions with the configured answers.
+	AuthMethodKeyboardInteractive AuthMethod = "keyboard-interactive"
+)
+
+// String creates a string representation.
+func (a AuthMethod) String() string {
+	return string(a)
+}
+
+// Validate checks if the authentication method is supported.
+func (a AuthMethod) Validate() error {
+	switch a {
+	case AuthMethodPublicKey:
+	case AuthMethodPassword:
+	case AuthMethodKeyboardInteractive:
+	default:
+		return fmt.Errorf("unsupported authentication method: %s", a)
+	}
+	return nil
+}
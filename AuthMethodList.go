@@ -0,0 +1,27 @@
+package sshproxy
+
+import (
+	"fmt"
+)
+
+// AuthMethodList is an ordered list of authentication methods.
+type AuthMethodList []AuthMethod
+
+// Validate checks that the list contains only supported methods, each at most once. The SSH client only tries each
+// method once, so duplicates would be ignored.
+func (a AuthMethodList) Validate() error {
+	if len(a) == 0 {
+		return fmt.Errorf("authentication method list cannot be empty")
+	}
+	seen := map[AuthMethod]bool{}
+	for _, method := range a {
+		if err := method.Validate(); err != nil {
+			return err
+		}
+		if seen[method] {
+			return fmt.Errorf("duplicate authentication method: %s", method)
+		}
+		seen[method] = true
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package sshproxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// unixSocketPrefix is the prefix of backend addresses pointing to a Unix socket.
+const unixSocketPrefix = "unix://"
+
+// isUnixSocketAddress returns true if the backend address points to a Unix socket.
+func isUnixSocketAddress(address string) bool {
+	return strings.HasPrefix(address, unixSocketPrefix)
+}
+
+// splitBackendAddress returns the network and the address to dial for a backend address.
+func splitBackendAddress(address string) (network string, dialAddress string) {
+	if isUnixSocketAddress(address) {
+		return "unix", strings.TrimPrefix(address, unixSocketPrefix)
+	}
+	return "tcp", address
+}
+
+// Backend is a backing SSH server in a pool of identical servers.
+type Backend struct {
+	// Server is the IP address or hostname of the backing server, or the path of a Unix socket in the
+	// unix:///path/to/socket format.
+	Server string `json:"server" yaml:"server"`
+	// Port is the TCP port to connect to. Defaults to 22.
+	Port uint16 `json:"port" yaml:"port" default:"22"`
+}
+
+// Validate checks the backend configuration.
+func (b Backend) Validate() error {
+	if b.Server == "" {
+		return fmt.Errorf("server cannot be empty")
+	}
+	if b.Server == unixSocketPrefix {
+		return fmt.Errorf("unix socket path cannot be empty")
+	}
+	return nil
+}
+
+// address returns the address of the backend in the host:port format, or the Unix socket address as is.
+func (b Backend) address() string {
+	if isUnixSocketAddress(b.Server) {
+		return b.Server
+	}
+	port := b.Port
+	if port == 0 {
+		port = 22
+	}
+	return net.JoinHostPort(b.Server, strconv.Itoa(int(port)))
+}
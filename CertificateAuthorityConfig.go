@@ -0,0 +1,52 @@
+package sshproxy
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// CertificateAuthorityConfig configures the SSH certificate authority that issues a short-lived user certificate for
+// each backend connection.
+type CertificateAuthorityConfig struct {
+	// PrivateKey is the private key of the certificate authority, or a file containing it. Certificates are only
+	// issued if this is set.
+	PrivateKey string `json:"privateKey" yaml:"privateKey"`
+	// PrivateKeyPassphrase is the passphrase to decrypt the private key of the certificate authority with.
+	PrivateKeyPassphrase string `json:"privateKeyPassphrase" yaml:"privateKeyPassphrase"`
+	// PrivateKeyPassphraseEnv is the name of an environment variable containing the passphrase for the private key.
+	PrivateKeyPassphraseEnv string `json:"privateKeyPassphraseEnv" yaml:"privateKeyPassphraseEnv"`
+	// PrivateKeyPassphraseFile is a file containing the passphrase for the private key.
+	PrivateKeyPassphraseFile string `json:"privateKeyPassphraseFile" yaml:"privateKeyPassphraseFile"`
+	// Validity is the time an issued certificate is valid for.
+	Validity time.Duration `json:"validity" yaml:"validity" default:"5m"`
+	// Extensions are the extensions added to the issued certificates.
+	Extensions map[string]string `json:"extensions" yaml:"extensions" default:"{\"permit-X11-forwarding\":\"\",\"permit-agent-forwarding\":\"\",\"permit-port-forwarding\":\"\",\"permit-pty\":\"\",\"permit-user-rc\":\"\"}"`
+}
+
+// Validate checks the certificate authority configuration.
+func (c CertificateAuthorityConfig) Validate() error {
+	if c.PrivateKey == "" {
+		return nil
+	}
+	if c.Validity <= 0 {
+		return fmt.Errorf("invalid certificate validity: %s", c.Validity)
+	}
+	return validatePassphraseSources(c.PrivateKeyPassphrase, c.PrivateKeyPassphraseEnv, c.PrivateKeyPassphraseFile)
+}
+
+func (c CertificateAuthorityConfig) loadPrivateKey() (ssh.Signer, error) {
+	if c.PrivateKey == "" {
+		return nil, nil
+	}
+	passphrase, err := loadPassphrase(c.PrivateKeyPassphrase, c.PrivateKeyPassphraseEnv, c.PrivateKeyPassphraseFile)
+	if err != nil {
+		return nil, err
+	}
+	private, err := loadPrivateKey(c.PrivateKey, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate authority private key (%w)", err)
+	}
+	return private, nil
+}
@@ -0,0 +1,38 @@
+package sshproxy
+
+import (
+	"fmt"
+	"time"
+)
+
+// CircuitBreakerConfig configures the circuit breaker for the backing servers. After FailureThreshold consecutive
+// failed connection attempts the circuit of a backend opens and new connections to it fail immediately. An attempt
+// fails if the backend cannot be connected or the SSH handshake with it fails or times out; a backend rejecting the
+// credentials is not a failure. After OpenDuration a limited number of connections are let through; if they complete the
+// SSH handshake the circuit closes, otherwise it opens again.
+type CircuitBreakerConfig struct {
+	// FailureThreshold is the number of consecutive failed connection attempts that open the circuit. The circuit
+	// breaker is disabled if this is 0.
+	FailureThreshold int `json:"failureThreshold" yaml:"failureThreshold"`
+	// OpenDuration is the time the circuit stays open before connections are let through again.
+	OpenDuration time.Duration `json:"openDuration" yaml:"openDuration" default:"30s"`
+	// HalfOpenAttempts is the number of connections let through at the same time after OpenDuration.
+	HalfOpenAttempts int `json:"halfOpenAttempts" yaml:"halfOpenAttempts" default:"1"`
+}
+
+// Validate checks the circuit breaker configuration.
+func (c CircuitBreakerConfig) Validate() error {
+	if c.FailureThreshold == 0 {
+		return nil
+	}
+	if c.FailureThreshold < 0 {
+		return fmt.Errorf("invalid circuit breaker failure threshold: %d", c.FailureThreshold)
+	}
+	if c.OpenDuration <= 0 {
+		return fmt.Errorf("invalid circuit breaker open duration: %s", c.OpenDuration)
+	}
+	if c.HalfOpenAttempts < 1 {
+		return fmt.Errorf("invalid circuit breaker half-open attempts: %d", c.HalfOpenAttempts)
+	}
+	return nil
+}
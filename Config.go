@@ -1,33 +1,141 @@
 package sshproxy
 
 import (
+	"bytes"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"strings"
 	"time"
 
+	"github.com/containerssh/http"
+	"github.com/containerssh/log"
+	"github.com/containerssh/metrics"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 
 	"github.com/containerssh/sshserver"
 )
 
 // Config is the configuration for the SSH proxy module.
 type Config struct {
-	// Server is the IP address or hostname of the backing server.
+	// Server is the IP address or hostname of the backing server, or the path of a Unix socket in the
+	// unix:///path/to/socket format. Host keys of Unix socket backends can only be verified with
+	// AllowedHostKeyFingerprints and the host key store.
 	Server string `json:"server" yaml:"server"`
-	// Port is the TCP port to connect to.
+	// Port is the TCP port to connect to. It is ignored for Unix sockets.
 	Port uint16 `json:"port" yaml:"port" default:"22"`
+	// Router selects the backend configuration for each connection. It can only be set from code. If set, the other
+	// options only serve as the defaults the router may use.
+	Router Router `json:"-" yaml:"-"`
+	// RouterWebhook configures an HTTP webhook that selects the backend configuration for each connection, see
+	// NewHTTPRouter. It is used if the URL is set and Router is not.
+	RouterWebhook http.ClientConfiguration `json:"routerWebhook" yaml:"routerWebhook"`
+	// Backends is a pool of identical backing servers to use instead of Server and Port.
+	Backends []Backend `json:"backends" yaml:"backends"`
+	// Fallbacks is an ordered list of backing servers to try if the selected backend cannot be connected or the SSH
+	// handshake fails before authentication. A backend rejecting the credentials is never failed over, and with
+	// AuthenticationPassThrough neither is a failed SSH handshake, so the credentials are only sent to one backend.
+	Fallbacks []Backend `json:"fallbacks" yaml:"fallbacks"`
+	// JumpHosts is the chain of SSH servers the backend connection is tunneled through, in order. The first jump host
+	// is connected directly, each following one and finally the backend from the previous jump host.
+	JumpHosts []JumpHostConfig `json:"jumpHosts" yaml:"jumpHosts"`
+	// ProxyCommand is a command that is started for each backend connection instead of connecting the backend, like the
+	// OpenSSH ProxyCommand option. ContainerSSH speaks SSH over its standard input and output, its error output is
+	// logged. The command is not run in a shell, each argument is a Go template receiving the Username,
+	// ConnectionID, RemoteAddress of the client, and the Server and Port of the backend. Username, ConnectionID and
+	// RemoteAddress are empty for health checks. The username is chosen by the client, so take care that it cannot
+	// change the meaning of the command, for example by passing it after a "--" argument. Values starting with a dash or
+	// containing control characters are rejected.
+	ProxyCommand []string `json:"proxyCommand" yaml:"proxyCommand"`
+	// UpstreamProxy is the URL of a proxy TCP connections to the backend or the first jump host are made through. The
+	// socks5://, socks5h:// and http:// (HTTP CONNECT) schemes are supported, credentials can be provided in the URL.
+	// With socks5:// hostnames are resolved by ContainerSSH, with socks5h:// and http:// by the proxy. Unix sockets are
+	// always connected directly. Certificates issued by CertificateAuthority are not restricted to a source address
+	// when an upstream proxy is used.
+	UpstreamProxy string `json:"upstreamProxy" yaml:"upstreamProxy"`
+	// ProxyProtocol sends a HAProxy PROXY protocol header with the client address to the backend before the SSH
+	// handshake. It can be empty to disable the header, v1, or v2.
+	ProxyProtocol ProxyProtocolVersion `json:"proxyProtocol" yaml:"proxyProtocol"`
+	// ProxyProtocolTLVs adds the connection ID and the username to the PROXY protocol v2 header as custom TLVs of type
+	// ProxyProtocolTLVConnectionID and ProxyProtocolTLVUsername.
+	ProxyProtocolTLVs bool `json:"proxyProtocolTLVs" yaml:"proxyProtocolTLVs"`
+	// LoadBalancing is the strategy selecting the backend from Backends for each connection.
+	LoadBalancing LoadBalancingStrategy `json:"loadBalancing" yaml:"loadBalancing" default:"round-robin"`
+	// HealthCheck configures the active health check of the backing servers.
+	HealthCheck HealthCheckConfig `json:"healthCheck" yaml:"healthCheck"`
+	// Retry is the retry policy for connecting the backing server.
+	Retry RetryConfig `json:"retry" yaml:"retry"`
+	// CircuitBreaker configures the circuit breaker that fails connections immediately while a backend keeps failing.
+	CircuitBreaker CircuitBreakerConfig `json:"circuitBreaker" yaml:"circuitBreaker"`
+	// BackendHealthMetric receives the health of each backing server as 1 or 0, labelled with the backend address. It
+	// can only be set from code.
+	BackendHealthMetric metrics.SimpleGauge `json:"-" yaml:"-"`
 	// UsernamePassThrough means that the username should be taken from the connecting client.
 	UsernamePassThrough bool `json:"usernamePassThrough" yaml:"usernamePassThrough"`
 	// Username is the username to pass to the backing SSH server for authentication.
 	Username string `json:"username" yaml:"username"`
 	// Password is the password to offer to the backing SSH server for authentication.
 	Password string `json:"password" yaml:"password"`
+	// AuthenticationPassThrough replays the credentials the client authenticates with against the backing server
+	// instead of relying on an external authentication. Password and keyboard-interactive authentication is supported,
+	// keyboard-interactive challenges from the backing server are relayed to the client. It requires
+	// UsernamePassThrough, otherwise any client knowing the password of Username could log in as that user.
+	AuthenticationPassThrough bool `json:"authenticationPassThrough" yaml:"authenticationPassThrough"`
 	// PrivateKey is the private key to use for authenticating with the backing server.
 	PrivateKey string `json:"privateKey" yaml:"privateKey"`
+	// PrivateKeys are additional private keys, or files containing them, offered after PrivateKey. They are decrypted
+	// with the same passphrase as PrivateKey.
+	PrivateKeys []string `json:"privateKeys" yaml:"privateKeys"`
+	// Certificates are user certificates for PrivateKey and PrivateKeys in authorized_keys format, or files containing
+	// them. A private key with a certificate is offered with the certificate instead of on its own.
+	Certificates []string `json:"certificates" yaml:"certificates"`
+	// PrivateKeyPassphrase is the passphrase to decrypt the private key with. It is also used for PrivateKeys and
+	// AgentKeys, keys that are not encrypted are loaded without it.
+	PrivateKeyPassphrase string `json:"privateKeyPassphrase" yaml:"privateKeyPassphrase"`
+	// PrivateKeyPassphraseEnv is the name of an environment variable containing the passphrase for the private key.
+	PrivateKeyPassphraseEnv string `json:"privateKeyPassphraseEnv" yaml:"privateKeyPassphraseEnv"`
+	// PrivateKeyPassphraseFile is a file containing the passphrase for the private key.
+	PrivateKeyPassphraseFile string `json:"privateKeyPassphraseFile" yaml:"privateKeyPassphraseFile"`
+	// KeyboardInteractiveAnswers maps the keyboard-interactive questions of the backing server to the answers
+	// ContainerSSH sends.
+	KeyboardInteractiveAnswers map[string]string `json:"keyboardInteractiveAnswers" yaml:"keyboardInteractiveAnswers"`
+	// AuthMethods is the ordered list of authentication methods offered to the backing server. The publickey method
+	// offers the certificate issued by CertificateAuthority first, then PrivateKey, then PrivateKeys, each with its
+	// certificate from Certificates if there is one. Methods without credentials are skipped. Leave out the password
+	// method to never send a password.
+	AuthMethods AuthMethodList `json:"authMethods" yaml:"authMethods" default:"[\"password\",\"publickey\"]"`
+	// CertificateAuthority configures a certificate authority that issues a short-lived certificate for each backend
+	// connection, signed for the username the client authenticated with.
+	CertificateAuthority CertificateAuthorityConfig `json:"certificateAuthority" yaml:"certificateAuthority"`
+	// AgentKeys is a list of private keys, or files containing them, that ContainerSSH serves as an SSH agent to the
+	// backing server. The keys are offered on every session, but never leave ContainerSSH. They are decrypted with the
+	// same passphrase as PrivateKey.
+	AgentKeys []string `json:"agentKeys" yaml:"agentKeys"`
 	// AllowedHostKeyFingerprints lists which fingerprints we accept
 	AllowedHostKeyFingerprints AllowedHostKeyFingerprints `json:"allowedHostKeyFingerprints" yaml:"allowedHostKeyFingerprints"`
+	// KnownHostsFiles is a list of OpenSSH known_hosts files to verify the backing server's host key against. Hashed
+	// hostnames, wildcards, and the @revoked and @cert-authority markers are supported.
+	KnownHostsFiles []string `json:"knownHostsFiles" yaml:"knownHostsFiles"`
+	// TrustedHostCAs is a list of certificate authority public keys in authorized_keys format. Host certificates signed
+	// by these CAs are accepted if they are currently valid and list Server as a principal.
+	TrustedHostCAs []string `json:"trustedHostCAs" yaml:"trustedHostCAs"`
+	// RevokedHostKeys lists the SHA256 fingerprints of revoked host keys. For host certificates the certified key and
+	// the signing CA are checked as well.
+	RevokedHostKeys []string `json:"revokedHostKeys" yaml:"revokedHostKeys"`
+	// HostKeyStoreFile is a file in known_hosts format ContainerSSH records host keys in. The keys in this file are
+	// accepted, and once a key is stored for a server no other keys are accepted for it.
+	HostKeyStoreFile string `json:"hostKeyStoreFile" yaml:"hostKeyStoreFile"`
+	// HostKeyStore replaces HostKeyStoreFile with a custom storage. It can only be set from code.
+	HostKeyStore HostKeyStore `json:"-" yaml:"-"`
+	// TrustOnFirstUse records the host key of the backing server in the host key store when it is first seen. Keys
+	// accepted by the other host key options are not recorded.
+	TrustOnFirstUse bool `json:"trustOnFirstUse" yaml:"trustOnFirstUse"`
+	// UpdateHostKeys processes the host keys the backing server announces using the hostkeys-00@openssh.com
+	// extension. Keys the server proves to hold are added to the host key store so host keys can be rotated.
+	UpdateHostKeys bool `json:"updateHostKeys" yaml:"updateHostKeys"`
 	// Ciphers are the ciphers supported for the backend connection.
 	Ciphers sshserver.CipherList `json:"ciphers" yaml:"ciphers" default:"[\"chacha20-poly1305@openssh.com\",\"aes256-gcm@openssh.com\",\"aes128-gcm@openssh.com\",\"aes256-ctr\",\"aes192-ctr\",\"aes128-ctr\"]" comment:"Cipher suites to use"`
 	// KexAlgorithms are the key exchange algorithms for the backend connection.
@@ -38,7 +146,8 @@ type Config struct {
 	// are the ones we want to accept. The fingerprints for the accepted algorithms should be added to
 	// AllowedHostKeyFingerprints.
 	HostKeyAlgorithms sshserver.KeyAlgoList `json:"hostKeyAlgos" yaml:"hostKeyAlgos" default:"[\"ssh-rsa-cert-v01@openssh.com\",\"ssh-dss-cert-v01@openssh.com\",\"ecdsa-sha2-nistp256-cert-v01@openssh.com\",\"ecdsa-sha2-nistp384-cert-v01@openssh.com\",\"ecdsa-sha2-nistp521-cert-v01@openssh.com\",\"ssh-ed25519-cert-v01@openssh.com\",\"ssh-rsa\",\"ssh-dss\",\"ssh-ed25519\"]"`
-	// Timeout is the time ContainerSSH is willing to wait for the backing connection to be established.
+	// Timeout is the time ContainerSSH is willing to wait for the backing connection to be established, including all
+	// retries and the SSH handshake.
 	Timeout time.Duration `json:"timeout" yaml:"timeout" default:"60s"`
 	// ClientVersion is the version sent to the server.
 	//               Must be in the format of "SSH-protoversion-softwareversion SPACE comments".
@@ -49,17 +158,110 @@ type Config struct {
 
 // Validate checks the configuration for the backing SSH server.
 func (c Config) Validate() error {
-	if c.Server == "" {
-		return fmt.Errorf("server cannot be empty")
+	if c.Router == nil && c.RouterWebhook.URL != "" {
+		routerWebhook := c.RouterWebhook
+		if err := routerWebhook.Validate(); err != nil {
+			return fmt.Errorf("invalid router webhook configuration (%w)", err)
+		}
+	}
+	// With a router the backend is configured per connection and validated then.
+	if c.Router != nil || c.RouterWebhook.URL != "" {
+		return nil
+	}
+	if c.Server == "" && len(c.Backends) == 0 {
+		return fmt.Errorf("server cannot be empty when no backends are set")
+	}
+	if c.Server != "" && len(c.Backends) > 0 {
+		return fmt.Errorf("server and backends cannot be set at the same time")
+	}
+	for i, backend := range c.Backends {
+		if err := backend.Validate(); err != nil {
+			return fmt.Errorf("invalid backend %d (%w)", i, err)
+		}
+	}
+	for i, backend := range c.Fallbacks {
+		if err := backend.Validate(); err != nil {
+			return fmt.Errorf("invalid fallback %d (%w)", i, err)
+		}
+	}
+	for i, jumpHost := range c.JumpHosts {
+		if err := jumpHost.Validate(); err != nil {
+			return fmt.Errorf("invalid jump host %d (%w)", i, err)
+		}
+	}
+	if len(c.ProxyCommand) > 0 && len(c.JumpHosts) > 0 {
+		return fmt.Errorf("proxyCommand and jumpHosts cannot be set at the same time")
 	}
-	if c.Port == 0 || c.Port > 65535 {
+	if err := c.ProxyProtocol.Validate(); err != nil {
+		return err
+	}
+	if c.ProxyProtocolTLVs && c.ProxyProtocol != ProxyProtocolV2 {
+		return fmt.Errorf("proxyProtocolTLVs requires proxyProtocol v2")
+	}
+	if c.UpstreamProxy != "" {
+		if len(c.ProxyCommand) > 0 {
+			return fmt.Errorf("proxyCommand and upstreamProxy cannot be set at the same time")
+		}
+		if _, err := newUpstreamProxy(c.UpstreamProxy); err != nil {
+			return err
+		}
+	}
+	if err := c.LoadBalancing.Validate(); err != nil {
+		return fmt.Errorf("invalid load balancing configuration (%w)", err)
+	}
+	if err := c.HealthCheck.Validate(); err != nil {
+		return fmt.Errorf("invalid health check configuration (%w)", err)
+	}
+	if err := c.Retry.Validate(); err != nil {
+		return fmt.Errorf("invalid retry configuration (%w)", err)
+	}
+	if err := c.CircuitBreaker.Validate(); err != nil {
+		return fmt.Errorf("invalid circuit breaker configuration (%w)", err)
+	}
+	if c.Server != "" {
+		if err := (Backend{Server: c.Server, Port: c.Port}).Validate(); err != nil {
+			return err
+		}
+	}
+	if !isUnixSocketAddress(c.Server) && (c.Port == 0 || c.Port > 65535) {
 		return fmt.Errorf("invalid port number: %d", c.Port)
 	}
+	if c.hasUnixSocketBackend() && (len(c.KnownHostsFiles) > 0 || len(c.TrustedHostCAs) > 0) {
+		return fmt.Errorf("knownHostsFiles and trustedHostCAs cannot be used with unix socket backends")
+	}
 	if c.Username == "" && !c.UsernamePassThrough {
 		return fmt.Errorf("username cannot be empty when usernamePassThrough is not set")
 	}
-	if len(c.AllowedHostKeyFingerprints) == 0 {
-		return fmt.Errorf("allowedHostKeyFingerprints cannot be empty")
+	if c.AuthenticationPassThrough && !c.UsernamePassThrough {
+		return fmt.Errorf("authenticationPassThrough requires usernamePassThrough")
+	}
+	if err := validatePassphraseSources(
+		c.PrivateKeyPassphrase,
+		c.PrivateKeyPassphraseEnv,
+		c.PrivateKeyPassphraseFile,
+	); err != nil {
+		return err
+	}
+	hasHostKeyStore := c.HostKeyStoreFile != "" || c.HostKeyStore != nil
+	if c.TrustOnFirstUse && !hasHostKeyStore {
+		return fmt.Errorf("hostKeyStoreFile cannot be empty when trustOnFirstUse is set")
+	}
+	if c.UpdateHostKeys && !hasHostKeyStore {
+		return fmt.Errorf("hostKeyStoreFile cannot be empty when updateHostKeys is set")
+	}
+	if len(c.AllowedHostKeyFingerprints) == 0 &&
+		len(c.KnownHostsFiles) == 0 &&
+		len(c.TrustedHostCAs) == 0 &&
+		!hasHostKeyStore {
+		return fmt.Errorf(
+			"allowedHostKeyFingerprints cannot be empty when no knownHostsFiles, trustedHostCAs, or hostKeyStoreFile are set",
+		)
+	}
+	if err := c.AuthMethods.Validate(); err != nil {
+		return fmt.Errorf("invalid authentication methods (%w)", err)
+	}
+	if err := c.CertificateAuthority.Validate(); err != nil {
+		return fmt.Errorf("invalid certificate authority configuration (%w)", err)
 	}
 	if err := c.Ciphers.Validate(); err != nil {
 		return fmt.Errorf("invalid cipher configuration (%w)", err)
@@ -79,30 +281,105 @@ func (c Config) Validate() error {
 	return nil
 }
 
-func (c Config) loadPrivateKey() (ssh.Signer, error) {
-	if c.PrivateKey == "" {
+// backendAddresses returns the addresses of the backing servers in the host:port format.
+func (c Config) backendAddresses() []string {
+	if len(c.Backends) == 0 {
+		return []string{Backend{Server: c.Server, Port: c.Port}.address()}
+	}
+	addresses := make([]string, len(c.Backends))
+	for i, backend := range c.Backends {
+		addresses[i] = backend.address()
+	}
+	return addresses
+}
+
+// hasUnixSocketBackend returns true if any of the backends or fallbacks is a Unix socket.
+func (c Config) hasUnixSocketBackend() bool {
+	for _, address := range append(c.backendAddresses(), c.fallbackAddresses("")...) {
+		if isUnixSocketAddress(address) {
+			return true
+		}
+	}
+	return false
+}
+
+// fallbackAddresses returns the addresses of the fallback servers in the host:port format, except the selected one.
+func (c Config) fallbackAddresses(selected string) []string {
+	var addresses []string
+	for _, backend := range c.Fallbacks {
+		if address := backend.address(); address != selected {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+func (c Config) loadPrivateKeys() ([]ssh.Signer, error) {
+	var privateKeys []string
+	if c.PrivateKey != "" {
+		privateKeys = append(privateKeys, c.PrivateKey)
+	}
+	privateKeys = append(privateKeys, c.PrivateKeys...)
+	if len(privateKeys) == 0 {
 		return nil, nil
 	}
-	privateKey := c.PrivateKey
-	if strings.TrimSpace(privateKey)[:5] != "-----" {
-		//Load file
-		fh, err := os.Open(privateKey)
+	passphrase, err := c.loadPrivateKeyPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	signers := make([]ssh.Signer, len(privateKeys))
+	for i, privateKey := range privateKeys {
+		signers[i], err = loadPrivateKey(privateKey, passphrase)
 		if err != nil {
-			return nil, fmt.Errorf("failed load private key %s (%w)", privateKey, err)
+			return nil, err
 		}
-		privateKeyData, err := ioutil.ReadAll(fh)
-		if err != nil {
-			_ = fh.Close()
-			return nil, fmt.Errorf("failed to load private key %s (%w)", privateKey, err)
+	}
+	for i, certificate := range c.Certificates {
+		if err := addCertificate(signers, certificate); err != nil {
+			return nil, fmt.Errorf("invalid certificate %d (%w)", i, err)
 		}
-		if err = fh.Close(); err != nil {
-			return nil, fmt.Errorf("failed to close host key file %s (%w)", privateKey, err)
+	}
+	return signers, nil
+}
+
+// addCertificate loads a user certificate and replaces the signer of the certified key with one presenting the
+// certificate.
+func addCertificate(signers []ssh.Signer, certificate string) error {
+	certificateData := []byte(certificate)
+	if !isInlineCertificate(certificate) {
+		var err error
+		if certificateData, err = ioutil.ReadFile(certificate); err != nil {
+			return fmt.Errorf("failed to load certificate %s (%w)", certificate, err)
 		}
-		privateKey = string(privateKeyData)
 	}
-	private, err := ssh.ParsePrivateKey([]byte(privateKey))
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(certificateData)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse private key (%w)", err)
+		return fmt.Errorf("failed to parse certificate (%w)", err)
+	}
+	cert, ok := publicKey.(*ssh.Certificate)
+	if !ok {
+		return fmt.Errorf("not a certificate: %s", publicKey.Type())
+	}
+	if cert.CertType != ssh.UserCert {
+		return fmt.Errorf("not a user certificate")
+	}
+	for i, signer := range signers {
+		if bytes.Equal(signer.PublicKey().Marshal(), cert.Key.Marshal()) {
+			signers[i], err = ssh.NewCertSigner(cert, signer)
+			return err
+		}
+	}
+	return fmt.Errorf("no private key matches the certificate for %s", ssh.FingerprintSHA256(cert.Key))
+}
+
+func loadPrivateKey(privateKey string, passphrase []byte) (ssh.Signer, error) {
+	rawPrivateKey, err := loadRawPrivateKey(privateKey, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	private, err := ssh.NewSignerFromKey(rawPrivateKey)
+	if err != nil {
+		return nil, log.Wrap(err, EPrivateKeyInvalid, "Failed to parse private key.")
 	}
 	keyType := private.PublicKey().Type()
 
@@ -111,3 +388,135 @@ func (c Config) loadPrivateKey() (ssh.Signer, error) {
 	}
 	return private, nil
 }
+
+// loadRawPrivateKey loads and parses a private key. Encrypted keys are decrypted with passphrase if it is not nil, keys
+// that are not encrypted are loaded as they are, so the same passphrase can be used for a mix of keys.
+func loadRawPrivateKey(privateKey string, passphrase []byte) (interface{}, error) {
+	privateKeyData, err := loadKeyData(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	private, err := ssh.ParseRawPrivateKey(privateKeyData)
+	var passphraseMissingError *ssh.PassphraseMissingError
+	if errors.As(err, &passphraseMissingError) && passphrase != nil {
+		private, err = ssh.ParseRawPrivateKeyWithPassphrase(privateKeyData, passphrase)
+	}
+	if err != nil {
+		switch {
+		case errors.As(err, &passphraseMissingError):
+			return nil, log.Wrap(
+				err,
+				EPrivateKeyPassphraseInvalid,
+				"The private key is encrypted, but no passphrase was provided.",
+			)
+		case errors.Is(err, x509.IncorrectPasswordError):
+			return nil, log.Wrap(err, EPrivateKeyPassphraseInvalid, "Incorrect passphrase for the private key.")
+		default:
+			return nil, log.Wrap(err, EPrivateKeyInvalid, "Failed to parse private key.")
+		}
+	}
+	return private, nil
+}
+
+// loadPrivateKeyPassphrase returns the passphrase for the private key from the configured source, or nil if no
+// passphrase is configured.
+func (c Config) loadPrivateKeyPassphrase() ([]byte, error) {
+	return loadPassphrase(c.PrivateKeyPassphrase, c.PrivateKeyPassphraseEnv, c.PrivateKeyPassphraseFile)
+}
+
+// validatePassphraseSources checks that at most one of the passphrase, the environment variable, and the file
+// containing the passphrase is set.
+func validatePassphraseSources(passphrase string, env string, file string) error {
+	passphraseSources := 0
+	for _, source := range []string{passphrase, env, file} {
+		if source != "" {
+			passphraseSources++
+		}
+	}
+	if passphraseSources > 1 {
+		return fmt.Errorf(
+			"only one of privateKeyPassphrase, privateKeyPassphraseEnv, and privateKeyPassphraseFile can be set",
+		)
+	}
+	return nil
+}
+
+// loadPassphrase returns the passphrase itself, or reads it from the environment variable or the file, whichever is
+// set. It returns nil if none of them is set.
+func loadPassphrase(passphrase string, env string, file string) ([]byte, error) {
+	switch {
+	case passphrase != "":
+		return []byte(passphrase), nil
+	case env != "":
+		value, ok := os.LookupEnv(env)
+		if !ok {
+			return nil, fmt.Errorf(
+				"the environment variable %s containing the private key passphrase is not set",
+				env,
+			)
+		}
+		return []byte(value), nil
+	case file != "":
+		value, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load private key passphrase %s (%w)", file, err)
+		}
+		return bytes.TrimRight(value, "\r\n"), nil
+	default:
+		return nil, nil
+	}
+}
+
+func (c Config) loadAgentKeys() (agent.Agent, error) {
+	if len(c.AgentKeys) == 0 {
+		return nil, nil
+	}
+	passphrase, err := c.loadPrivateKeyPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	keyring := agent.NewKeyring()
+	for i, agentKey := range c.AgentKeys {
+		private, err := loadRawPrivateKey(agentKey, passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load agent key %d (%w)", i, err)
+		}
+		if err := keyring.Add(agent.AddedKey{
+			PrivateKey: private,
+			Comment:    fmt.Sprintf("ContainerSSH agent key %d", i),
+		}); err != nil {
+			return nil, fmt.Errorf("failed to add agent key %d (%w)", i, err)
+		}
+	}
+	return keyring, nil
+}
+
+// isInlineCertificate returns true if the certificate is provided in authorized_keys format instead of a file name.
+func isInlineCertificate(certificate string) bool {
+	return strings.Contains(certificate, "-cert-v01@openssh.com ")
+}
+
+// isInlineKey returns true if the key is provided in PEM format instead of a file name.
+func isInlineKey(key string) bool {
+	return strings.HasPrefix(strings.TrimSpace(key), "-----")
+}
+
+// loadKeyData returns the key if it is provided in PEM format, or loads it from the file the key points to.
+func loadKeyData(key string) ([]byte, error) {
+	if isInlineKey(key) {
+		return []byte(key), nil
+	}
+	fh, err := os.Open(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed load private key %s (%w)", key, err)
+	}
+	keyData, err := ioutil.ReadAll(fh)
+	if err != nil {
+		_ = fh.Close()
+		return nil, fmt.Errorf("failed to load private key %s (%w)", key, err)
+	}
+	if err = fh.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close host key file %s (%w)", key, err)
+	}
+	return keyData, nil
+}
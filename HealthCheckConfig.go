@@ -0,0 +1,39 @@
+package sshproxy
+
+import (
+	"fmt"
+	"time"
+)
+
+// HealthCheckConfig configures the active health check of the backing servers. The health check connects each backend
+// periodically and performs an SSH key exchange. Backends failing the health check do not receive new connections. The
+// health check of a backend runs while at least one connection uses it. While no connection uses a backend its last
+// known health is kept for an hour, and the next connection is refused right away if the backend was unhealthy.
+// Connections share the health check of a backend if they reach it the same way; a backend reached through different
+// jump hosts, proxies, or health check options is checked separately for each.
+type HealthCheckConfig struct {
+	// Interval is the time between two health checks of a backend. The health check is disabled if this is 0.
+	Interval time.Duration `json:"interval" yaml:"interval"`
+	// Timeout is the time a single health check may take.
+	Timeout time.Duration `json:"timeout" yaml:"timeout" default:"5s"`
+	// FailureThreshold is the number of consecutive failed health checks after which a backend is considered
+	// unhealthy. A single successful health check makes the backend healthy again.
+	FailureThreshold int `json:"failureThreshold" yaml:"failureThreshold" default:"2"`
+}
+
+// Validate checks the health check configuration.
+func (c HealthCheckConfig) Validate() error {
+	if c.Interval == 0 {
+		return nil
+	}
+	if c.Interval < 0 {
+		return fmt.Errorf("invalid health check interval: %s", c.Interval)
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("invalid health check timeout: %s", c.Timeout)
+	}
+	if c.FailureThreshold < 1 {
+		return fmt.Errorf("invalid health check failure threshold: %d", c.FailureThreshold)
+	}
+	return nil
+}
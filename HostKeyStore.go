@@ -0,0 +1,26 @@
+package sshproxy
+
+import (
+	"golang.org/x/crypto/ssh"
+)
+
+// HostKeyStore persists the host keys of backing servers for trust on first use.
+type HostKeyStore interface {
+	// Get returns the host keys stored for the address in the host:port format. It returns an empty list if no keys
+	// are stored.
+	Get(address string) ([]ssh.PublicKey, error)
+	// Add stores an additional host key for the address in the host:port format.
+	Add(address string, key ssh.PublicKey) error
+	// AddFirst stores the host key for the address in the host:port format only if no key is stored for it yet. The
+	// check and the write must be atomic so concurrent first connections cannot record different keys. It returns
+	// true if the key is stored for the address afterwards, and false if other keys were already stored.
+	AddFirst(address string, key ssh.PublicKey) (bool, error)
+}
+
+// NewFileHostKeyStore creates a HostKeyStore that stores the host keys in a file in the OpenSSH known_hosts format.
+// The file is created when the first key is added.
+func NewFileHostKeyStore(file string) HostKeyStore {
+	return &fileHostKeyStore{
+		file: file,
+	}
+}
@@ -0,0 +1,58 @@
+package sshproxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// JumpHostConfig configures an SSH server the backend connection is tunneled through, like the OpenSSH ProxyJump
+// option.
+type JumpHostConfig struct {
+	// Server is the IP address or hostname of the jump host.
+	Server string `json:"server" yaml:"server"`
+	// Port is the TCP port of the jump host. Defaults to 22.
+	Port uint16 `json:"port" yaml:"port" default:"22"`
+	// Username is the username to authenticate with on the jump host.
+	Username string `json:"username" yaml:"username"`
+	// Password is the password to authenticate with on the jump host.
+	Password string `json:"password" yaml:"password"`
+	// PrivateKey is the private key, or a file containing it, to authenticate with on the jump host.
+	PrivateKey string `json:"privateKey" yaml:"privateKey"`
+	// PrivateKeyPassphrase is the passphrase to decrypt the private key of the jump host with.
+	PrivateKeyPassphrase string `json:"privateKeyPassphrase" yaml:"privateKeyPassphrase"`
+	// PrivateKeyPassphraseEnv is the name of an environment variable containing the passphrase for the private key.
+	PrivateKeyPassphraseEnv string `json:"privateKeyPassphraseEnv" yaml:"privateKeyPassphraseEnv"`
+	// PrivateKeyPassphraseFile is a file containing the passphrase for the private key.
+	PrivateKeyPassphraseFile string `json:"privateKeyPassphraseFile" yaml:"privateKeyPassphraseFile"`
+	// AllowedHostKeyFingerprints lists the SHA256 fingerprints of the host keys accepted from the jump host.
+	AllowedHostKeyFingerprints AllowedHostKeyFingerprints `json:"allowedHostKeyFingerprints" yaml:"allowedHostKeyFingerprints"`
+	// KnownHostsFiles is a list of OpenSSH known_hosts files to verify the jump host's host key against.
+	KnownHostsFiles []string `json:"knownHostsFiles" yaml:"knownHostsFiles"`
+}
+
+// Validate checks the jump host configuration.
+func (j JumpHostConfig) Validate() error {
+	if j.Server == "" {
+		return fmt.Errorf("server cannot be empty")
+	}
+	if j.Username == "" {
+		return fmt.Errorf("username cannot be empty")
+	}
+	if j.Password == "" && j.PrivateKey == "" {
+		return fmt.Errorf("password or privateKey must be set")
+	}
+	if len(j.AllowedHostKeyFingerprints) == 0 && len(j.KnownHostsFiles) == 0 {
+		return fmt.Errorf("allowedHostKeyFingerprints cannot be empty when no knownHostsFiles are set")
+	}
+	return validatePassphraseSources(j.PrivateKeyPassphrase, j.PrivateKeyPassphraseEnv, j.PrivateKeyPassphraseFile)
+}
+
+// address returns the address of the jump host in the host:port format.
+func (j JumpHostConfig) address() string {
+	port := j.Port
+	if port == 0 {
+		port = 22
+	}
+	return net.JoinHostPort(j.Server, strconv.Itoa(int(port)))
+}
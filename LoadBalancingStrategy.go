@@ -0,0 +1,39 @@
+package sshproxy
+
+import (
+	"fmt"
+)
+
+// LoadBalancingStrategy selects which backend of the pool a new connection is sent to.
+type LoadBalancingStrategy string
+
+// LoadBalancingStrategy are the supported load balancing strategies.
+const (
+	// LoadBalancingRoundRobin sends connections to the backends in turn.
+	LoadBalancingRoundRobin LoadBalancingStrategy = "round-robin"
+	// LoadBalancingRandom sends connections to a randomly chosen backend.
+	LoadBalancingRandom LoadBalancingStrategy = "random"
+	// LoadBalancingLeastConnections sends connections to the backend with the fewest active connections.
+	LoadBalancingLeastConnections LoadBalancingStrategy = "least-connections"
+	// LoadBalancingConsistentHash always sends the same username to the same backend as long as the pool does not
+	// change. When a backend is removed only its users are moved to other backends.
+	LoadBalancingConsistentHash LoadBalancingStrategy = "consistent-hash"
+)
+
+// String creates a string representation.
+func (l LoadBalancingStrategy) String() string {
+	return string(l)
+}
+
+// Validate checks if the load balancing strategy is supported.
+func (l LoadBalancingStrategy) Validate() error {
+	switch l {
+	case LoadBalancingRoundRobin:
+	case LoadBalancingRandom:
+	case LoadBalancingLeastConnections:
+	case LoadBalancingConsistentHash:
+	default:
+		return fmt.Errorf("unsupported load balancing strategy: %s", l)
+	}
+	return nil
+}
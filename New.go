@@ -24,20 +24,85 @@ func New(
 		return nil, err
 	}
 
-	privateKey, err := config.loadPrivateKey()
-	if err != nil {
-		return nil, err
+	router := config.Router
+	if router == nil && config.RouterWebhook.URL != "" {
+		var err error
+		router, err = NewHTTPRouter(config.RouterWebhook, logger)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return &networkConnectionHandler{
+	handler := &networkConnectionHandler{
 		lock:                  &sync.Mutex{},
 		wg:                    &sync.WaitGroup{},
 		client:                client,
 		connectionID:          connectionID,
 		config:                config,
-		logger:                logger.WithLabel("server", config.Server).WithLabel("port", config.Port),
+		logger:                logger,
 		backendRequestsMetric: backendRequestsMetric,
 		backendFailuresMetric: backendFailuresMetric,
-		privateKey:            privateKey,
-	}, nil
+		router:                router,
+	}
+	// With a router the backend is configured once the username is known.
+	if router == nil {
+		if err := handler.configure(config); err != nil {
+			return nil, err
+		}
+	}
+	return handler, nil
+}
+
+// configure sets up the handler for connecting the backend described by config.
+func (s *networkConnectionHandler) configure(config Config) error {
+	privateKeys, err := config.loadPrivateKeys()
+	if err != nil {
+		return err
+	}
+
+	ca, err := newCertificateAuthority(config.CertificateAuthority)
+	if err != nil {
+		return err
+	}
+
+	agentKeyring, err := config.loadAgentKeys()
+	if err != nil {
+		return err
+	}
+
+	logger := s.logger
+	switch {
+	case len(config.Backends) > 0:
+	case isUnixSocketAddress(config.Server):
+		logger = logger.WithLabel("server", config.Server)
+	default:
+		logger = logger.WithLabel("server", config.Server).WithLabel("port", config.Port)
+	}
+
+	verifier, err := newHostKeyVerifier(config, logger)
+	if err != nil {
+		return err
+	}
+
+	dialer, err := newBackendDialer(config, s.connectionID, s.client, logger)
+	if err != nil {
+		return err
+	}
+
+	releaseHealthCheckers(s.healthCheckers)
+	releaseCircuitBreakers(s.circuitBreakers)
+	if s.backendPool != nil {
+		releaseBackendPool(s.backendPool)
+	}
+	s.config = config
+	s.logger = logger
+	s.backendPool = getBackendPool(config)
+	s.dialer = dialer
+	s.healthCheckers = getHealthCheckers(config, dialer, logger)
+	s.circuitBreakers = getCircuitBreakers(config)
+	s.privateKeys = privateKeys
+	s.certificateAuthority = ca
+	s.hostKeyVerifier = verifier
+	s.agentKeyring = agentKeyring
+	return nil
 }
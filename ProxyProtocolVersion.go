@@ -0,0 +1,43 @@
+package sshproxy
+
+import (
+	"fmt"
+)
+
+// ProxyProtocolVersion is the version of the HAProxy PROXY protocol header sent to the backend.
+type ProxyProtocolVersion string
+
+// ProxyProtocolVersion are the supported PROXY protocol versions.
+const (
+	// ProxyProtocolDisabled sends no PROXY protocol header.
+	ProxyProtocolDisabled ProxyProtocolVersion = ""
+	// ProxyProtocolV1 sends the human-readable version 1 header.
+	ProxyProtocolV1 ProxyProtocolVersion = "v1"
+	// ProxyProtocolV2 sends the binary version 2 header, which can also carry TLVs.
+	ProxyProtocolV2 ProxyProtocolVersion = "v2"
+)
+
+// The custom TLV types used in the PROXY protocol v2 header when TLVs are enabled.
+const (
+	// ProxyProtocolTLVConnectionID carries the ContainerSSH connection ID.
+	ProxyProtocolTLVConnectionID byte = 0xE0
+	// ProxyProtocolTLVUsername carries the username the client authenticated with.
+	ProxyProtocolTLVUsername byte = 0xE1
+)
+
+// String creates a string representation.
+func (p ProxyProtocolVersion) String() string {
+	return string(p)
+}
+
+// Validate checks if the PROXY protocol version is supported.
+func (p ProxyProtocolVersion) Validate() error {
+	switch p {
+	case ProxyProtocolDisabled:
+	case ProxyProtocolV1:
+	case ProxyProtocolV2:
+	default:
+		return fmt.Errorf("unsupported PROXY protocol version: %s", p)
+	}
+	return nil
+}
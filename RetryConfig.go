@@ -0,0 +1,98 @@
+package sshproxy
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RetryCondition is a class of errors after which the connection to the backend is retried.
+type RetryCondition string
+
+// RetryCondition are the supported retry conditions.
+const (
+	// RetryOnConnectionFailure retries when the TCP connection to the backend fails.
+	RetryOnConnectionFailure RetryCondition = "connection"
+	// RetryOnHandshakeFailure retries when the SSH handshake with the backend fails, including the backend closing the
+	// connection during authentication. The backend rejecting the credentials is never retried, and with
+	// authentication pass-through failed handshakes are not retried either so the credentials of the user are only
+	// sent once.
+	RetryOnHandshakeFailure RetryCondition = "handshake"
+)
+
+// Validate checks if the retry condition is supported.
+func (r RetryCondition) Validate() error {
+	switch r {
+	case RetryOnConnectionFailure:
+	case RetryOnHandshakeFailure:
+	default:
+		return fmt.Errorf("unsupported retry condition: %s", r)
+	}
+	return nil
+}
+
+// RetryConfig is the retry policy for connecting the backend. Each attempt tries the selected backend and the
+// fallbacks once. The delay between attempts starts at InitialDelay and is multiplied by Multiplier after each attempt
+// up to MaxDelay. Attempts stop when Timeout is reached.
+type RetryConfig struct {
+	// MaxAttempts is the maximum number of attempts. There is no limit other than Timeout if this is 0.
+	MaxAttempts int `json:"maxAttempts" yaml:"maxAttempts"`
+	// InitialDelay is the delay before the second attempt.
+	InitialDelay time.Duration `json:"initialDelay" yaml:"initialDelay" default:"10s"`
+	// Multiplier is the factor the delay is multiplied with after each attempt.
+	Multiplier float64 `json:"multiplier" yaml:"multiplier" default:"1"`
+	// MaxDelay is the longest delay between two attempts, including the jitter.
+	MaxDelay time.Duration `json:"maxDelay" yaml:"maxDelay" default:"60s"`
+	// Jitter randomly changes each delay by up to this fraction, between 0 and 1, so clients do not retry in lockstep.
+	Jitter float64 `json:"jitter" yaml:"jitter"`
+	// RetryOn lists the errors after which another attempt is made.
+	RetryOn []RetryCondition `json:"retryOn" yaml:"retryOn" default:"[\"connection\"]"`
+}
+
+// Validate checks the retry policy.
+func (r RetryConfig) Validate() error {
+	if r.MaxAttempts < 0 {
+		return fmt.Errorf("invalid maximum attempts: %d", r.MaxAttempts)
+	}
+	if r.InitialDelay < 0 {
+		return fmt.Errorf("invalid initial delay: %s", r.InitialDelay)
+	}
+	if r.Multiplier < 1 {
+		return fmt.Errorf("invalid multiplier: %f", r.Multiplier)
+	}
+	if r.MaxDelay < r.InitialDelay {
+		return fmt.Errorf("the maximum delay %s is shorter than the initial delay %s", r.MaxDelay, r.InitialDelay)
+	}
+	if r.Jitter < 0 || r.Jitter > 1 {
+		return fmt.Errorf("invalid jitter: %f", r.Jitter)
+	}
+	for _, condition := range r.RetryOn {
+		if err := condition.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retryOn returns true if the policy retries after errors of the condition.
+func (r RetryConfig) retryOn(condition RetryCondition) bool {
+	for _, c := range r.RetryOn {
+		if c == condition {
+			return true
+		}
+	}
+	return false
+}
+
+// delay returns the delay after the attempt, counting from 1.
+func (r RetryConfig) delay(attempt int) time.Duration {
+	delay := float64(r.InitialDelay) * math.Pow(r.Multiplier, float64(attempt-1))
+	if r.Jitter > 0 {
+		delay *= 1 + r.Jitter*(2*rand.Float64()-1)
+	}
+	if delay > float64(r.MaxDelay) {
+		delay = float64(r.MaxDelay)
+	}
+	return time.Duration(delay)
+}
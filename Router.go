@@ -0,0 +1,13 @@
+package sshproxy
+
+import (
+	"net"
+)
+
+// Router selects the backend for a connection. It is consulted once per connection before the backend is connected.
+type Router interface {
+	// Route returns the backend configuration for the connection of the user from the client address. The returned
+	// configuration replaces the proxy configuration for this connection, its Router and RouterWebhook options are
+	// ignored.
+	Route(username string, client net.TCPAddr, connectionID string) (Config, error)
+}
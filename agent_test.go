@@ -0,0 +1,103 @@
+package sshproxy_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestAgentKeys(t *testing.T) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate agent key (%v)", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatalf("failed to marshal agent key (%v)", err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatalf("failed to create agent key signer (%v)", err)
+	}
+
+	agentKeys := make(chan []*agent.Key, 1)
+	backend := startTestBackend(
+		t,
+		&ssh.ServerConfig{
+			PasswordCallback: func(_ ssh.ConnMetadata, _ []byte) (*ssh.Permissions, error) {
+				return nil, nil
+			},
+		},
+		func(conn *ssh.ServerConn, channels <-chan ssh.NewChannel, requests <-chan *ssh.Request) {
+			go ssh.DiscardRequests(requests)
+			for newChannel := range channels {
+				channel, channelRequests, err := newChannel.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer func() {
+						_ = channel.Close()
+					}()
+					for request := range channelRequests {
+						if request.Type != "auth-agent-req@openssh.com" {
+							_ = request.Reply(false, nil)
+							continue
+						}
+						_ = request.Reply(true, nil)
+						agentChannel, agentRequests, err := conn.OpenChannel("auth-agent@openssh.com", nil)
+						if err != nil {
+							t.Errorf("failed to open agent channel (%v)", err)
+							return
+						}
+						go ssh.DiscardRequests(agentRequests)
+						keys, err := agent.NewClient(agentChannel).List()
+						if err != nil {
+							t.Errorf("failed to list agent keys (%v)", err)
+						}
+						agentKeys <- keys
+						_ = agentChannel.Close()
+					}
+				}()
+			}
+		},
+	)
+
+	config := backend.config()
+	config.AgentKeys = []string{
+		string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+	}
+	proxy, err := newTestProxy(t, config)
+	if err != nil {
+		t.Fatalf("failed to create proxy (%v)", err)
+	}
+	defer proxy.OnDisconnect()
+	connection, err := proxy.OnHandshakeSuccess("test")
+	if err != nil {
+		t.Fatalf("failed to connect to backend (%v)", err)
+	}
+	session, rejection := connection.OnSessionChannel(0, nil, &testSessionChannel{})
+	if rejection != nil {
+		t.Fatalf("failed to open session (%v)", rejection)
+	}
+	defer session.OnClose()
+
+	select {
+	case keys := <-agentKeys:
+		if len(keys) != 1 {
+			t.Fatalf("unexpected number of agent keys: %d", len(keys))
+		}
+		if !bytes.Equal(keys[0].Blob, signer.PublicKey().Marshal()) {
+			t.Fatalf("the agent offered an unexpected key: %s", keys[0].String())
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timeout while waiting for the backend to list agent keys")
+	}
+}
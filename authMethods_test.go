@@ -0,0 +1,158 @@
+package sshproxy_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/containerssh/sshproxy"
+)
+
+// generateTestPrivateKey generates an ed25519 key and returns it in PEM format along with its signer.
+func generateTestPrivateKey(t *testing.T) (string, ssh.Signer) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key (%v)", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatalf("failed to marshal key (%v)", err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatalf("failed to create signer (%v)", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), signer
+}
+
+func TestAuthMethods(t *testing.T) {
+	firstKey, firstSigner := generateTestPrivateKey(t)
+	secondKey, secondSigner := generateTestPrivateKey(t)
+	caSigner := generateTestSigner(t)
+	cert := &ssh.Certificate{
+		Key:             secondSigner.PublicKey(),
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"test"},
+		ValidAfter:      uint64(time.Now().Add(-time.Hour).Unix()),
+		ValidBefore:     uint64(time.Now().Add(time.Hour).Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, caSigner); err != nil {
+		t.Fatalf("failed to sign certificate (%v)", err)
+	}
+	certificate := string(ssh.MarshalAuthorizedKey(cert))
+
+	name := func(key ssh.PublicKey) string {
+		switch {
+		case bytes.Equal(key.Marshal(), firstSigner.PublicKey().Marshal()):
+			return "publickey:first"
+		case bytes.Equal(key.Marshal(), secondSigner.PublicKey().Marshal()):
+			return "publickey:second"
+		case bytes.Equal(key.Marshal(), cert.Marshal()):
+			return "publickey:certificate"
+		default:
+			return "publickey:unknown"
+		}
+	}
+
+	for testName, testCase := range map[string]struct {
+		authMethods  sshproxy.AuthMethodList
+		certificates []string
+		accept       string
+		expected     []string
+	}{
+		"password-first": {
+			authMethods: sshproxy.AuthMethodList{sshproxy.AuthMethodPassword, sshproxy.AuthMethodPublicKey},
+			accept:      "publickey:second",
+			expected:    []string{"password", "publickey:first", "publickey:second"},
+		},
+		"no-password": {
+			authMethods: sshproxy.AuthMethodList{
+				sshproxy.AuthMethodPublicKey,
+				sshproxy.AuthMethodKeyboardInteractive,
+			},
+			accept:   "keyboard-interactive",
+			expected: []string{"publickey:first", "publickey:second", "keyboard-interactive"},
+		},
+		"keyboard-interactive-first": {
+			authMethods: sshproxy.AuthMethodList{
+				sshproxy.AuthMethodKeyboardInteractive,
+				sshproxy.AuthMethodPublicKey,
+			},
+			accept:   "publickey:first",
+			expected: []string{"keyboard-interactive", "publickey:first"},
+		},
+		"certificate": {
+			authMethods:  sshproxy.AuthMethodList{sshproxy.AuthMethodPublicKey},
+			certificates: []string{certificate},
+			accept:       "publickey:certificate",
+			expected:     []string{"publickey:first", "publickey:certificate"},
+		},
+	} {
+		t.Run(testName, func(t *testing.T) {
+			lock := &sync.Mutex{}
+			var attempts []string
+			record := func(attempt string) error {
+				lock.Lock()
+				defer lock.Unlock()
+				attempts = append(attempts, attempt)
+				if attempt == testCase.accept {
+					return nil
+				}
+				return fmt.Errorf("rejected")
+			}
+			backend := startTestBackend(
+				t,
+				&ssh.ServerConfig{
+					PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+						return nil, record("password")
+					},
+					PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+						return nil, record(name(key))
+					},
+					KeyboardInteractiveCallback: func(
+						conn ssh.ConnMetadata,
+						challenge ssh.KeyboardInteractiveChallenge,
+					) (*ssh.Permissions, error) {
+						answers, err := challenge(conn.User(), "", []string{"Code: "}, []bool{false})
+						if err != nil {
+							return nil, err
+						}
+						if len(answers) != 1 || answers[0] != "123456" {
+							return nil, fmt.Errorf("invalid answer")
+						}
+						return nil, record("keyboard-interactive")
+					},
+				},
+				func(conn *ssh.ServerConn, channels <-chan ssh.NewChannel, requests <-chan *ssh.Request) {
+					go ssh.DiscardRequests(requests)
+					rejectChannels(channels)
+				},
+			)
+
+			config := backend.config()
+			config.AuthMethods = testCase.authMethods
+			config.PrivateKey = firstKey
+			config.PrivateKeys = []string{secondKey}
+			config.Certificates = testCase.certificates
+			config.KeyboardInteractiveAnswers = map[string]string{"Code: ": "123456"}
+			config.Retry.MaxAttempts = 1
+			if err := connectHostKeyTestBackend(t, config); err != nil {
+				t.Fatalf("failed to authenticate with the backend (%v)", err)
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			if !reflect.DeepEqual(attempts, testCase.expected) {
+				t.Fatalf("unexpected authentication attempts: %v, expected: %v", attempts, testCase.expected)
+			}
+		})
+	}
+}
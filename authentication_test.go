@@ -0,0 +1,217 @@
+package sshproxy_test
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/containerssh/log"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/containerssh/sshproxy"
+	"github.com/containerssh/sshserver"
+)
+
+func TestPasswordPassThrough(t *testing.T) {
+	var connections int32
+	backend := startTestBackend(
+		t,
+		&ssh.ServerConfig{
+			PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+				if conn.User() == "test" && string(password) == "secret" {
+					return nil, nil
+				}
+				return nil, fmt.Errorf("invalid credentials")
+			},
+		},
+		func(conn *ssh.ServerConn, channels <-chan ssh.NewChannel, requests <-chan *ssh.Request) {
+			atomic.AddInt32(&connections, 1)
+			go ssh.DiscardRequests(requests)
+			rejectChannels(channels)
+		},
+	)
+
+	config := backend.config()
+	config.AuthenticationPassThrough = true
+	config.UsernamePassThrough = true
+	config.Username = ""
+	config.Password = ""
+	proxy, err := newTestProxy(t, config)
+	if err != nil {
+		t.Fatalf("failed to create proxy (%v)", err)
+	}
+	defer proxy.OnDisconnect()
+
+	response, err := proxy.OnAuthPassword("test", []byte("invalid"))
+	if response != sshserver.AuthResponseFailure {
+		t.Fatalf("unexpected response for an invalid password: %d (%v)", response, err)
+	}
+	response, err = proxy.OnAuthPassword("test", []byte("secret"))
+	if response != sshserver.AuthResponseSuccess {
+		t.Fatalf("unexpected response for a valid password: %d (%v)", response, err)
+	}
+	if _, err := proxy.OnHandshakeSuccess("test"); err != nil {
+		t.Fatalf("failed to reuse the authenticated backend connection (%v)", err)
+	}
+	if n := atomic.LoadInt32(&connections); n != 1 {
+		t.Fatalf("unexpected number of authenticated backend connections: %d", n)
+	}
+}
+
+// testProxyHandler creates a proxy for each connection of an SSH server and records the keyboard-interactive
+// authentication responses of the proxies.
+type testProxyHandler struct {
+	sshserver.AbstractHandler
+
+	t         *testing.T
+	config    sshproxy.Config
+	responses chan sshserver.AuthResponse
+}
+
+func (h *testProxyHandler) OnNetworkConnection(_ net.TCPAddr, _ string) (sshserver.NetworkConnectionHandler, error) {
+	proxy, err := newTestProxy(h.t, h.config)
+	if err != nil {
+		return nil, err
+	}
+	return &testRecordingNetworkHandler{
+		NetworkConnectionHandler: proxy,
+		responses:                h.responses,
+	}, nil
+}
+
+type testRecordingNetworkHandler struct {
+	sshserver.NetworkConnectionHandler
+
+	responses chan sshserver.AuthResponse
+}
+
+func (r *testRecordingNetworkHandler) OnAuthKeyboardInteractive(
+	username string,
+	challenge func(
+		instruction string,
+		questions sshserver.KeyboardInteractiveQuestions,
+	) (answers sshserver.KeyboardInteractiveAnswers, err error),
+) (sshserver.AuthResponse, error) {
+	response, err := r.NetworkConnectionHandler.OnAuthKeyboardInteractive(username, challenge)
+	r.responses <- response
+	return response, err
+}
+
+func TestKeyboardInteractivePassThrough(t *testing.T) {
+	backend := startTestBackend(
+		t,
+		&ssh.ServerConfig{
+			KeyboardInteractiveCallback: func(
+				conn ssh.ConnMetadata,
+				challenge ssh.KeyboardInteractiveChallenge,
+			) (*ssh.Permissions, error) {
+				answers, err := challenge(
+					conn.User(),
+					"Two-factor authentication",
+					[]string{"Username: ", "Code: "},
+					[]bool{true, false},
+				)
+				if err != nil {
+					return nil, err
+				}
+				if !reflect.DeepEqual(answers, []string{"test", "123456"}) {
+					return nil, fmt.Errorf("invalid answers")
+				}
+				// A challenge without questions only shows the instruction.
+				if _, err := challenge(conn.User(), "Welcome", nil, nil); err != nil {
+					return nil, err
+				}
+				return nil, nil
+			},
+		},
+		func(conn *ssh.ServerConn, channels <-chan ssh.NewChannel, requests <-chan *ssh.Request) {
+			go ssh.DiscardRequests(requests)
+			rejectChannels(channels)
+		},
+	)
+
+	config := backend.config()
+	config.AuthenticationPassThrough = true
+	config.UsernamePassThrough = true
+	config.Username = ""
+	config.Password = ""
+	config.Retry.MaxAttempts = 1
+	handler := &testProxyHandler{
+		t:         t,
+		config:    config,
+		responses: make(chan sshserver.AuthResponse, 10),
+	}
+	server := sshserver.NewTestServer(handler, log.NewTestLogger(t))
+	server.Start()
+	defer server.Stop(10 * time.Second)
+
+	for name, testCase := range map[string]struct {
+		code             string
+		expectedResponse sshserver.AuthResponse
+	}{
+		"correct": {
+			code:             "123456",
+			expectedResponse: sshserver.AuthResponseSuccess,
+		},
+		"wrong": {
+			code:             "654321",
+			expectedResponse: sshserver.AuthResponseFailure,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var instructions []string
+			var challenges [][]string
+			var echos [][]bool
+			client, err := ssh.Dial("tcp", server.GetListen(), &ssh.ClientConfig{
+				User: "test",
+				Auth: []ssh.AuthMethod{
+					ssh.RetryableAuthMethod(ssh.KeyboardInteractive(
+						func(_ string, instruction string, questions []string, echo []bool) ([]string, error) {
+							instructions = append(instructions, instruction)
+							challenges = append(challenges, questions)
+							echos = append(echos, echo)
+							answers := map[string]string{
+								"Username: ": "test",
+								"Code: ":     testCase.code,
+							}
+							result := make([]string, len(questions))
+							for i, question := range questions {
+								result[i] = answers[question]
+							}
+							return result, nil
+						},
+					), 1),
+				},
+				HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			})
+			if client != nil {
+				_ = client.Close()
+			}
+			response := <-handler.responses
+			if response != testCase.expectedResponse {
+				t.Fatalf("unexpected keyboard-interactive response: %d (%v)", response, err)
+			}
+			if len(challenges) == 0 ||
+				!reflect.DeepEqual(challenges[0], []string{"Username: ", "Code: "}) ||
+				!reflect.DeepEqual(echos[0], []bool{true, false}) ||
+				instructions[0] != "Two-factor authentication" {
+				t.Fatalf("the challenge was not relayed as sent by the backend: %v %v %v", instructions, challenges, echos)
+			}
+			if testCase.expectedResponse != sshserver.AuthResponseSuccess {
+				if err == nil {
+					t.Fatalf("the client was authenticated with a wrong answer")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to authenticate through the proxy (%v)", err)
+			}
+			if len(challenges) != 2 || len(challenges[1]) != 0 || instructions[1] != "Welcome" {
+				t.Fatalf("the challenge without questions was not relayed: %v %v", instructions, challenges)
+			}
+		})
+	}
+}
@@ -0,0 +1,308 @@
+package sshproxy
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/containerssh/log"
+	"golang.org/x/crypto/ssh"
+)
+
+// backendDialer opens the network connection to a backend, either directly, through the configured jump hosts, or
+// by starting the proxy command. Direct TCP connections and the connection to the first jump host use the upstream
+// proxy if configured. The PROXY protocol header is sent on the resulting connection if configured.
+type backendDialer struct {
+	upstreamProxy     *upstreamProxy
+	jumpHosts         []*jumpHost
+	proxyCommand      *proxyCommand
+	proxyProtocol     ProxyProtocolVersion
+	proxyProtocolTLVs bool
+	connectionID      string
+	client            *net.TCPAddr
+	remoteAddress     string
+}
+
+func newBackendDialer(
+	config Config,
+	connectionID string,
+	client net.TCPAddr,
+	logger log.Logger,
+) (*backendDialer, error) {
+	dialer := &backendDialer{
+		proxyProtocol:     config.ProxyProtocol,
+		proxyProtocolTLVs: config.ProxyProtocolTLVs,
+		connectionID:      connectionID,
+		client:            &client,
+		remoteAddress:     client.IP.String(),
+	}
+	if config.UpstreamProxy != "" {
+		upstreamProxy, err := newUpstreamProxy(config.UpstreamProxy)
+		if err != nil {
+			return nil, err
+		}
+		dialer.upstreamProxy = upstreamProxy
+	}
+	if len(config.ProxyCommand) > 0 {
+		proxyCommand, err := newProxyCommand(config.ProxyCommand, logger)
+		if err != nil {
+			return nil, err
+		}
+		dialer.proxyCommand = proxyCommand
+	}
+	for i, jumpHostConfig := range config.JumpHosts {
+		hop, err := newJumpHost(i, jumpHostConfig, config, logger)
+		if err != nil {
+			return nil, err
+		}
+		dialer.jumpHosts = append(dialer.jumpHosts, hop)
+	}
+	return dialer, nil
+}
+
+// withoutConnection returns a copy of the dialer for connections not belonging to a client, such as health checks.
+func (d *backendDialer) withoutConnection() *backendDialer {
+	dialer := *d
+	dialer.connectionID = ""
+	dialer.client = nil
+	dialer.remoteAddress = ""
+	return &dialer
+}
+
+// dial connects the target address for the user. Errors of the jump hosts and the proxy command are returned as log
+// messages with their own codes.
+func (d *backendDialer) dial(ctx context.Context, target string, username string) (net.Conn, error) {
+	conn, err := d.dialTarget(ctx, target, username)
+	if err != nil || d.proxyProtocol == ProxyProtocolDisabled {
+		return conn, err
+	}
+	if err := d.writeProxyProtocolHeader(conn, username); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (d *backendDialer) dialTarget(ctx context.Context, target string, username string) (net.Conn, error) {
+	switch {
+	case d.proxyCommand != nil:
+		return d.startProxyCommand(target, username)
+	case len(d.jumpHosts) > 0:
+		return d.dialJumpHosts(ctx, target)
+	default:
+		network, address := splitBackendAddress(target)
+		return d.dialNetwork(ctx, network, address)
+	}
+}
+
+// dialNetwork connects the address directly, or through the upstream proxy for TCP addresses.
+func (d *backendDialer) dialNetwork(ctx context.Context, network string, address string) (net.Conn, error) {
+	if network == "tcp" && d.upstreamProxy != nil {
+		return d.upstreamProxy.dial(ctx, address)
+	}
+	dialer := &net.Dialer{}
+	return dialer.DialContext(ctx, network, address)
+}
+
+// writeProxyProtocolHeader sends the client address to the backend before the SSH handshake.
+func (d *backendDialer) writeProxyProtocolHeader(conn net.Conn, username string) error {
+	header := proxyProtocolHeader{
+		source:      d.client,
+		destination: conn.RemoteAddr(),
+	}
+	if d.proxyProtocolTLVs {
+		header.tlvs = map[byte]string{
+			ProxyProtocolTLVConnectionID: d.connectionID,
+			ProxyProtocolTLVUsername:     username,
+		}
+	}
+	data, err := header.marshal(d.proxyProtocol)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(data)
+	return err
+}
+
+func (d *backendDialer) startProxyCommand(target string, username string) (net.Conn, error) {
+	var server, port string
+	if network, address := splitBackendAddress(target); network == "unix" {
+		server = address
+	} else {
+		var err error
+		server, port, err = net.SplitHostPort(target)
+		if err != nil {
+			return nil, err
+		}
+	}
+	conn, err := d.proxyCommand.start(
+		proxyCommandData{
+			Username:      username,
+			ConnectionID:  d.connectionID,
+			RemoteAddress: d.remoteAddress,
+			Server:        server,
+			Port:          port,
+		},
+		target,
+	)
+	if err != nil {
+		return nil, log.WrapUser(
+			err,
+			EProxyCommandFailed,
+			"SSH service is currently unavailable.",
+			"Failed to start the proxy command for backend %s.",
+			target,
+		).Label("backend", target)
+	}
+	return conn, nil
+}
+
+// dialJumpHosts connects the first jump host, opens a direct-tcpip channel to the next jump host through each, and
+// finally to the target from the last jump host.
+func (d *backendDialer) dialJumpHosts(ctx context.Context, target string) (net.Conn, error) {
+	var clients []*ssh.Client
+	for i, hop := range d.jumpHosts {
+		var conn net.Conn
+		var err error
+		if i == 0 {
+			conn, err = d.dialNetwork(ctx, "tcp", hop.address)
+		} else {
+			conn, err = dialThroughJumpHost(ctx, clients[i-1], "tcp", hop.address)
+		}
+		if err != nil {
+			closeJumpHostClients(clients)
+			if getErrorCode(err) != "" {
+				return nil, err
+			}
+			return nil, log.WrapUser(
+				err,
+				EJumpHostConnectionFailed,
+				"SSH service is currently unavailable.",
+				"Connection to jump host %d (%s) failed.",
+				i+1,
+				hop.address,
+			).Label("jumpHost", hop.address)
+		}
+		client, err := hop.connect(ctx, conn)
+		if err != nil {
+			_ = conn.Close()
+			closeJumpHostClients(clients)
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+	network, address := splitBackendAddress(target)
+	conn, err := dialThroughJumpHost(ctx, clients[len(clients)-1], network, address)
+	if err != nil {
+		closeJumpHostClients(clients)
+		return nil, err
+	}
+	return &jumpHostConn{
+		Conn:    conn,
+		clients: clients,
+	}, nil
+}
+
+// dialThroughJumpHost opens a direct-tcpip channel to the address through the jump host. The SSH library does not
+// support cancelling the channel request, so if ctx is done first the error is returned right away and the caller
+// closes the jump host connections, which ends the request.
+func dialThroughJumpHost(ctx context.Context, client *ssh.Client, network string, address string) (net.Conn, error) {
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	result := make(chan dialResult, 1)
+	go func() {
+		conn, err := client.Dial(network, address)
+		result <- dialResult{conn: conn, err: err}
+	}()
+	select {
+	case r := <-result:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-result; r.conn != nil {
+				_ = r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// handshakeStage is the stage of the SSH handshake a failure happened in.
+type handshakeStage int
+
+const (
+	// handshakeStageKeyExchange is a failure before the host key was checked, including timeouts.
+	handshakeStageKeyExchange handshakeStage = iota
+	// handshakeStageHostKey is a host key rejected by the verifier. The error is the one returned by the verifier.
+	handshakeStageHostKey
+	// handshakeStageAuthentication is the server rejecting the credentials. Other failures after the host key was
+	// accepted, such as the server closing the connection during authentication, are in handshakeStageKeyExchange.
+	handshakeStageAuthentication
+)
+
+// sshHandshake performs the SSH handshake over conn with the host key verified by verifier. The handshake is aborted
+// by closing conn when ctx is done. On failure it also returns the stage the handshake failed in.
+func sshHandshake(
+	ctx context.Context,
+	conn net.Conn,
+	address string,
+	config *ssh.ClientConfig,
+	verifier *hostKeyVerifier,
+) (ssh.Conn, <-chan ssh.NewChannel, <-chan *ssh.Request, handshakeStage, error) {
+	clientConfig := *config
+	// The SSH library does not wrap the host key error, so we keep it to report the specific reason. The host key is
+	// verified once the key exchange is complete, so failures after accepting it happen during authentication.
+	var hostKeyError error
+	hostKeyAccepted := false
+	clientConfig.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		hostKeyError = verifier.verify(hostname, remote, key)
+		hostKeyAccepted = hostKeyError == nil
+		return hostKeyError
+	}
+	stopHandshakeTimeout := closeOnCancel(ctx, conn)
+	sshConn, newChannels, requests, err := ssh.NewClientConn(conn, address, &clientConfig)
+	timedOut := stopHandshakeTimeout()
+	if timedOut && err == nil {
+		_ = sshConn.Close()
+		err = ctx.Err()
+	}
+	switch {
+	case err == nil:
+		return sshConn, newChannels, requests, 0, nil
+	case hostKeyError != nil:
+		return nil, nil, nil, handshakeStageHostKey, hostKeyError
+	case hostKeyAccepted && !timedOut && isAuthenticationError(err):
+		return nil, nil, nil, handshakeStageAuthentication, err
+	default:
+		return nil, nil, nil, handshakeStageKeyExchange, err
+	}
+}
+
+// isAuthenticationError returns true if the SSH library gave up authenticating because the server rejected all
+// credentials. The library does not provide a typed error for this, so the message is matched.
+func isAuthenticationError(err error) bool {
+	return strings.Contains(err.Error(), "ssh: unable to authenticate")
+}
+
+// closeOnCancel closes conn when ctx is done before the returned function is called. The returned function reports if
+// conn was closed. Connections tunneled through jump hosts do not support deadlines, so this is used to time out the
+// SSH handshake instead.
+func closeOnCancel(ctx context.Context, conn net.Conn) func() bool {
+	done := make(chan struct{})
+	closed := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+			closed <- true
+		case <-done:
+			closed <- false
+		}
+	}()
+	return func() bool {
+		close(done)
+		return <-closed
+	}
+}
@@ -0,0 +1,144 @@
+package sshproxy
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backendPools holds the pools shared by all connections using the same backends and strategy. New is called for each
+// connection, so the pool state cannot live on the handler. Pools no longer used by any connection are removed after
+// backendStateRetention.
+var backendPools = map[string]*backendPool{}
+var backendPoolsLock = &sync.Mutex{}
+
+// backendPool selects the backend for a new connection and tracks the active connections on each backend.
+type backendPool struct {
+	lock      *sync.Mutex
+	strategy  LoadBalancingStrategy
+	addresses []string
+	next      int
+	active    map[string]int
+	// users and lastUsed are protected by backendPoolsLock.
+	users    int
+	lastUsed time.Time
+}
+
+// getBackendPool returns the shared pool for the backends and strategy in the configuration. The pool must be given back
+// with releaseBackendPool.
+func getBackendPool(config Config) *backendPool {
+	addresses := config.backendAddresses()
+	key := config.LoadBalancing.String() + " " + strings.Join(addresses, " ")
+
+	backendPoolsLock.Lock()
+	defer backendPoolsLock.Unlock()
+	pool, ok := backendPools[key]
+	if !ok {
+		pool = &backendPool{
+			lock:      &sync.Mutex{},
+			strategy:  config.LoadBalancing,
+			addresses: addresses,
+			active:    map[string]int{},
+		}
+		backendPools[key] = pool
+	}
+	pool.users++
+	return pool
+}
+
+// releaseBackendPool gives back a pool returned by getBackendPool and removes the pools that have not been used for
+// backendStateRetention.
+func releaseBackendPool(pool *backendPool) {
+	backendPoolsLock.Lock()
+	defer backendPoolsLock.Unlock()
+	pool.users--
+	pool.lastUsed = time.Now()
+	for key, pool := range backendPools {
+		if pool.users <= 0 && time.Since(pool.lastUsed) > backendStateRetention {
+			delete(backendPools, key)
+		}
+	}
+}
+
+// acquire selects a backend for the username and counts a connection on it. Backends for which isHealthy returns false
+// are only selected if no backend is healthy. The connection must be given back with release.
+func (p *backendPool) acquire(username string, isHealthy func(address string) bool) string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var addresses []string
+	for _, address := range p.addresses {
+		if isHealthy(address) {
+			addresses = append(addresses, address)
+		}
+	}
+	if len(addresses) == 0 {
+		addresses = p.addresses
+	}
+	var address string
+	switch p.strategy {
+	case LoadBalancingRandom:
+		address = addresses[rand.Intn(len(addresses))]
+	case LoadBalancingLeastConnections:
+		address = p.leastConnections(addresses)
+	case LoadBalancingConsistentHash:
+		address = p.consistentHash(addresses, username)
+	default:
+		address = addresses[p.next%len(addresses)]
+		p.next = (p.next + 1) % len(p.addresses)
+	}
+	p.active[address]++
+	return address
+}
+
+// release gives back a connection acquired on the backend.
+func (p *backendPool) release(address string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.active[address] > 0 {
+		p.active[address]--
+	}
+}
+
+// move counts a connection acquired on one backend on another instead, such as a fallback it was made to.
+func (p *backendPool) move(from string, to string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.active[from] > 0 {
+		p.active[from]--
+	}
+	p.active[to]++
+}
+
+// leastConnections returns the backend with the fewest active connections. Ties are broken in turn so an idle pool is
+// still used evenly.
+func (p *backendPool) leastConnections(addresses []string) string {
+	var result string
+	for i := range addresses {
+		address := addresses[(p.next+i)%len(addresses)]
+		if result == "" || p.active[address] < p.active[result] {
+			result = address
+		}
+	}
+	p.next = (p.next + 1) % len(p.addresses)
+	return result
+}
+
+// consistentHash returns the backend for the username using rendezvous hashing: every backend is scored by hashing it
+// together with the username and the highest score wins.
+func (p *backendPool) consistentHash(addresses []string, username string) string {
+	var result string
+	var maxScore uint64
+	for _, address := range addresses {
+		hash := fnv.New64a()
+		_, _ = hash.Write([]byte(username))
+		_, _ = hash.Write([]byte{0})
+		_, _ = hash.Write([]byte(address))
+		if score := hash.Sum64(); result == "" || score > maxScore {
+			result = address
+			maxScore = score
+		}
+	}
+	return result
+}
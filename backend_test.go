@@ -0,0 +1,148 @@
+package sshproxy_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/containerssh/geoip"
+	"github.com/containerssh/log"
+	"github.com/containerssh/metrics"
+	"github.com/containerssh/structutils"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/containerssh/sshproxy"
+	"github.com/containerssh/sshserver"
+)
+
+// testBackend is an in-process SSH server the proxy can connect to in tests.
+type testBackend struct {
+	listener    net.Listener
+	hostKey     ssh.Signer
+	fingerprint string
+}
+
+// startTestBackend starts an SSH server on a random local port. Every connection that completes the handshake is
+// passed to handleConnection.
+func startTestBackend(
+	t *testing.T,
+	serverConfig *ssh.ServerConfig,
+	handleConnection func(conn *ssh.ServerConn, channels <-chan ssh.NewChannel, requests <-chan *ssh.Request),
+) *testBackend {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate host key (%v)", err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatalf("failed to create host key signer (%v)", err)
+	}
+	serverConfig.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen (%v)", err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		for {
+			tcpConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn, channels, requests, err := ssh.NewServerConn(tcpConn, serverConfig)
+				if err != nil {
+					_ = tcpConn.Close()
+					return
+				}
+				handleConnection(conn, channels, requests)
+			}()
+		}
+	}()
+	return &testBackend{
+		listener:    listener,
+		hostKey:     hostKey,
+		fingerprint: ssh.FingerprintSHA256(hostKey.PublicKey()),
+	}
+}
+
+// config returns a proxy configuration pointing to the test backend.
+func (b *testBackend) config() sshproxy.Config {
+	config := sshproxy.Config{}
+	structutils.Defaults(&config)
+	addr := b.listener.Addr().(*net.TCPAddr)
+	config.Server = addr.IP.String()
+	config.Port = uint16(addr.Port)
+	config.Username = "test"
+	config.Password = "test"
+	config.AllowedHostKeyFingerprints = []string{b.fingerprint}
+	return config
+}
+
+func newTestCollector(t *testing.T) metrics.Collector {
+	geoipProvider, err := geoip.New(
+		geoip.Config{
+			Provider: geoip.DummyProvider,
+		},
+	)
+	if err != nil {
+		t.Fatalf("failed to create GeoIP provider (%v)", err)
+	}
+	return metrics.New(geoipProvider)
+}
+
+func newTestProxy(t *testing.T, config sshproxy.Config) (sshserver.NetworkConnectionHandler, error) {
+	collector := newTestCollector(t)
+	return sshproxy.New(
+		net.TCPAddr{
+			IP:   net.ParseIP("127.0.0.1"),
+			Port: 2222,
+		},
+		sshserver.GenerateConnectionID(),
+		config,
+		log.NewTestLogger(t),
+		collector.MustCreateCounter("backend_requests", "", ""),
+		collector.MustCreateCounter("backend_failures", "", ""),
+	)
+}
+
+// rejectChannels rejects all channels on a backend connection.
+func rejectChannels(channels <-chan ssh.NewChannel) {
+	for newChannel := range channels {
+		_ = newChannel.Reject(ssh.UnknownChannelType, "not supported")
+	}
+}
+
+// testSessionChannel is a client-facing session that discards all output.
+type testSessionChannel struct{}
+
+func (t *testSessionChannel) Stdin() io.Reader {
+	return bytes.NewReader(nil)
+}
+
+func (t *testSessionChannel) Stdout() io.Writer {
+	return ioutil.Discard
+}
+
+func (t *testSessionChannel) Stderr() io.Writer {
+	return ioutil.Discard
+}
+
+func (t *testSessionChannel) ExitStatus(_ uint32) {}
+
+func (t *testSessionChannel) ExitSignal(_ string, _ bool, _ string, _ string) {}
+
+func (t *testSessionChannel) CloseWrite() error {
+	return nil
+}
+
+func (t *testSessionChannel) Close() error {
+	return nil
+}
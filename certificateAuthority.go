@@ -0,0 +1,78 @@
+package sshproxy
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// certificateAuthority issues short-lived user certificates for backend connections.
+type certificateAuthority struct {
+	config CertificateAuthorityConfig
+	signer ssh.Signer
+}
+
+func newCertificateAuthority(config CertificateAuthorityConfig) (*certificateAuthority, error) {
+	signer, err := config.loadPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	if signer == nil {
+		return nil, nil
+	}
+	return &certificateAuthority{
+		config: config,
+		signer: signer,
+	}, nil
+}
+
+// issue generates a new key and returns a signer presenting a certificate for principal. If sourceAddress is a TCP
+// address with a known IP the certificate is restricted to be used from that IP address only.
+func (c *certificateAuthority) issue(principal string, keyID string, sourceAddress net.Addr) (ssh.Signer, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate certificate key (%w)", err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate key signer (%w)", err)
+	}
+	serial := make([]byte, 8)
+	if _, err := rand.Read(serial); err != nil {
+		return nil, fmt.Errorf("failed to generate certificate serial (%w)", err)
+	}
+
+	criticalOptions := map[string]string{}
+	if tcpAddr, ok := sourceAddress.(*net.TCPAddr); ok && !tcpAddr.IP.IsUnspecified() {
+		criticalOptions["source-address"] = tcpAddr.IP.String()
+	}
+	extensions := map[string]string{}
+	for name, value := range c.config.Extensions {
+		extensions[name] = value
+	}
+
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             signer.PublicKey(),
+		Serial:          binary.BigEndian.Uint64(serial),
+		CertType:        ssh.UserCert,
+		KeyId:           keyID,
+		ValidPrincipals: []string{principal},
+		// Allow for some clock skew between ContainerSSH and the backend.
+		ValidAfter:  uint64(now.Add(-time.Minute).Unix()),
+		ValidBefore: uint64(now.Add(c.config.Validity).Unix()),
+		Permissions: ssh.Permissions{
+			CriticalOptions: criticalOptions,
+			Extensions:      extensions,
+		},
+	}
+	if err := cert.SignCert(rand.Reader, c.signer); err != nil {
+		return nil, fmt.Errorf("failed to sign certificate (%w)", err)
+	}
+	return ssh.NewCertSigner(cert, signer)
+}
@@ -0,0 +1,100 @@
+package sshproxy_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestCertificateAuthority(t *testing.T) {
+	_, caPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate CA key (%v)", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(caPrivate)
+	if err != nil {
+		t.Fatalf("failed to marshal CA key (%v)", err)
+	}
+	caSigner, err := ssh.NewSignerFromKey(caPrivate)
+	if err != nil {
+		t.Fatalf("failed to create CA signer (%v)", err)
+	}
+
+	certificates := make(chan *ssh.Certificate, 1)
+	certChecker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), caSigner.PublicKey().Marshal())
+		},
+	}
+	backend := startTestBackend(
+		t,
+		&ssh.ServerConfig{
+			PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+				cert, ok := key.(*ssh.Certificate)
+				if !ok {
+					return nil, fmt.Errorf("not a certificate")
+				}
+				permissions, err := certChecker.Authenticate(conn, key)
+				if err != nil {
+					return nil, err
+				}
+				certificates <- cert
+				return permissions, nil
+			},
+		},
+		func(conn *ssh.ServerConn, channels <-chan ssh.NewChannel, requests <-chan *ssh.Request) {
+			go ssh.DiscardRequests(requests)
+			rejectChannels(channels)
+		},
+	)
+
+	httpAddress := startTestUpstreamProxy(t, serveTestHTTPConnect)
+
+	for name, testCase := range map[string]struct {
+		upstreamProxy string
+		sourceAddress string
+	}{
+		"direct": {
+			sourceAddress: "127.0.0.1",
+		},
+		// The backend sees the address of the upstream proxy, so the certificate cannot be restricted to ours.
+		"upstream-proxy": {
+			upstreamProxy: "http://proxy:proxy@" + httpAddress,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			config := backend.config()
+			config.UsernamePassThrough = true
+			config.Password = ""
+			config.UpstreamProxy = testCase.upstreamProxy
+			config.CertificateAuthority.PrivateKey = string(
+				pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}),
+			)
+			proxy, err := newTestProxy(t, config)
+			if err != nil {
+				t.Fatalf("failed to create proxy (%v)", err)
+			}
+			defer proxy.OnDisconnect()
+			if _, err := proxy.OnHandshakeSuccess("test"); err != nil {
+				t.Fatalf("failed to authenticate with certificate (%v)", err)
+			}
+
+			cert := <-certificates
+			if len(cert.ValidPrincipals) != 1 || cert.ValidPrincipals[0] != "test" {
+				t.Fatalf("unexpected principals: %v", cert.ValidPrincipals)
+			}
+			if cert.CriticalOptions["source-address"] != testCase.sourceAddress {
+				t.Fatalf("unexpected source address: %s", cert.CriticalOptions["source-address"])
+			}
+			if _, ok := cert.Extensions["permit-pty"]; !ok {
+				t.Fatalf("the default extensions are missing from the certificate")
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package sshproxy
+
+import (
+	"sync"
+	"time"
+)
+
+// circuitBreakers holds the circuit breakers by backend address, shared by all connections. Circuit breakers no longer
+// used by any connection are removed after backendStateRetention.
+var circuitBreakers = map[string]*circuitBreaker{}
+var circuitBreakersLock = &sync.Mutex{}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitBreaker tracks the failed connection attempts to a single backend.
+type circuitBreaker struct {
+	lock     *sync.Mutex
+	config   CircuitBreakerConfig
+	state    circuitState
+	failures int
+	openedAt time.Time
+	attempts int
+	// users and lastUsed are protected by circuitBreakersLock.
+	users    int
+	lastUsed time.Time
+}
+
+// getCircuitBreakers returns the circuit breakers for all backends of the configuration. It returns nil if the circuit
+// breaker is disabled. The circuit breakers must be given back with releaseCircuitBreakers.
+func getCircuitBreakers(config Config) map[string]*circuitBreaker {
+	if config.CircuitBreaker.FailureThreshold == 0 {
+		return nil
+	}
+	circuitBreakersLock.Lock()
+	defer circuitBreakersLock.Unlock()
+	result := map[string]*circuitBreaker{}
+	for _, address := range append(config.backendAddresses(), config.fallbackAddresses("")...) {
+		breaker, ok := circuitBreakers[address]
+		if !ok {
+			breaker = &circuitBreaker{
+				lock:   &sync.Mutex{},
+				config: config.CircuitBreaker,
+			}
+			circuitBreakers[address] = breaker
+		}
+		if _, ok := result[address]; !ok {
+			breaker.users++
+		}
+		result[address] = breaker
+	}
+	return result
+}
+
+// releaseCircuitBreakers gives back the circuit breakers returned by getCircuitBreakers and removes the circuit breakers
+// that have not been used for backendStateRetention.
+func releaseCircuitBreakers(breakers map[string]*circuitBreaker) {
+	circuitBreakersLock.Lock()
+	defer circuitBreakersLock.Unlock()
+	for _, breaker := range breakers {
+		breaker.users--
+		breaker.lastUsed = time.Now()
+	}
+	for address, breaker := range circuitBreakers {
+		if breaker.users <= 0 && time.Since(breaker.lastUsed) > backendStateRetention {
+			delete(circuitBreakers, address)
+		}
+	}
+}
+
+// isOpen returns true if connections to the backend currently fail immediately.
+func (c *circuitBreaker) isOpen() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	switch c.state {
+	case circuitOpen:
+		return time.Since(c.openedAt) < c.config.OpenDuration
+	case circuitHalfOpen:
+		return c.attempts >= c.config.HalfOpenAttempts
+	default:
+		return false
+	}
+}
+
+// allow returns true if a connection attempt may be made. Every allowed attempt must be followed by a call to
+// success, failure, or cancel.
+func (c *circuitBreaker) allow() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.state == circuitOpen && time.Since(c.openedAt) >= c.config.OpenDuration {
+		c.state = circuitHalfOpen
+		c.attempts = 0
+	}
+	switch c.state {
+	case circuitOpen:
+		return false
+	case circuitHalfOpen:
+		if c.attempts >= c.config.HalfOpenAttempts {
+			return false
+		}
+		c.attempts++
+		return true
+	default:
+		return true
+	}
+}
+
+// cancel gives back an allowed connection attempt that ended without showing whether the backend works.
+func (c *circuitBreaker) cancel() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.state == circuitHalfOpen && c.attempts > 0 {
+		c.attempts--
+	}
+}
+
+// success records a successful connection attempt and closes the circuit.
+func (c *circuitBreaker) success() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.state = circuitClosed
+	c.failures = 0
+	c.attempts = 0
+}
+
+// failure records a failed connection attempt. It returns true if the circuit opened because of this failure.
+func (c *circuitBreaker) failure() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	switch c.state {
+	case circuitOpen:
+		return false
+	case circuitHalfOpen:
+	default:
+		c.failures++
+		if c.failures < c.config.FailureThreshold {
+			return false
+		}
+	}
+	c.state = circuitOpen
+	c.openedAt = time.Now()
+	c.attempts = 0
+	return true
+}
@@ -0,0 +1,55 @@
+package sshproxy_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/containerssh/sshproxy"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	backend := startHostKeyTestBackend(t)
+	_ = backend.listener.Close()
+
+	config := backend.config()
+	config.Timeout = 100 * time.Millisecond
+	config.CircuitBreaker.FailureThreshold = 1
+	config.CircuitBreaker.OpenDuration = 500 * time.Millisecond
+
+	assertErrorCode(t, connectHostKeyTestBackend(t, config), sshproxy.EBackendConnectionFailed)
+
+	start := time.Now()
+	assertErrorCode(t, connectHostKeyTestBackend(t, config), sshproxy.EBackendCircuitOpen)
+	if elapsed := time.Since(start); elapsed > config.Timeout {
+		t.Fatalf("the open circuit did not fail immediately: %s", elapsed)
+	}
+
+	// After the open duration a connection attempt is let through again.
+	time.Sleep(config.CircuitBreaker.OpenDuration)
+	assertErrorCode(t, connectHostKeyTestBackend(t, config), sshproxy.EBackendConnectionFailed)
+}
+
+func TestCircuitBreakerHandshakeFailure(t *testing.T) {
+	// The backend accepts the TCP connections, but drops the first two during the SSH handshake.
+	backend := startHostKeyTestBackend(t)
+	addr := startDroppingListener(t, backend, 2)
+
+	config := backend.config()
+	config.Port = uint16(addr.Port)
+	config.Retry.MaxAttempts = 1
+	config.CircuitBreaker.FailureThreshold = 1
+	config.CircuitBreaker.OpenDuration = 500 * time.Millisecond
+
+	assertErrorCode(t, connectHostKeyTestBackend(t, config), sshproxy.EBackendHandshakeFailed)
+	assertErrorCode(t, connectHostKeyTestBackend(t, config), sshproxy.EBackendCircuitOpen)
+
+	// The attempt let through after the open duration connects, but fails the handshake, so the circuit opens again.
+	time.Sleep(config.CircuitBreaker.OpenDuration)
+	assertErrorCode(t, connectHostKeyTestBackend(t, config), sshproxy.EBackendHandshakeFailed)
+	assertErrorCode(t, connectHostKeyTestBackend(t, config), sshproxy.EBackendCircuitOpen)
+
+	time.Sleep(config.CircuitBreaker.OpenDuration)
+	if err := connectHostKeyTestBackend(t, config); err != nil {
+		t.Fatalf("failed to connect backend after the circuit closed (%v)", err)
+	}
+}
@@ -7,15 +7,78 @@ const EBackendConnectionFailed = "SSHPROXY_BACKEND_FAILED"
 // The operation couldn't complete because the user already disconnected
 const EDisconnected = "SSHPROXY_DISCONNECTED"
 
-// The connection could not be established because the backend refused our authentication attempt. This is usually due
-// to misconfigured credentials to the backend.
+// The connection could not be established because the SSH handshake with the backend failed for a reason other than
+// rejected credentials, for example because the backend closed the connection, also during authentication, or there
+// are no common algorithms.
 const EBackendHandshakeFailed = "SSHPROXY_BACKEND_HANDSHAKE_FAILED"
 
+// The backend failed the configured number of consecutive health checks and does not receive new connections until it
+// passes a health check again. On the debug level this message is logged for each failed health check.
+const EBackendUnhealthy = "SSHPROXY_BACKEND_UNHEALTHY"
+
+// The circuit breaker for the backend is open because too many connection attempts failed in a row. New connections to
+// the backend fail immediately until the circuit breaker lets a connection attempt through again. This message is
+// logged on the warning level when the circuit opens.
+const EBackendCircuitOpen = "SSHPROXY_BACKEND_CIRCUIT_OPEN"
+
+// The backend passed a health check after it was considered unhealthy.
+const MBackendHealthy = "SSHPROXY_BACKEND_HEALTHY"
+
+// The router could not provide a valid backend configuration for the connection. This is usually because the routing
+// webhook is unreachable or returned an invalid configuration.
+const ERoutingFailed = "SSHPROXY_ROUTING_FAILED"
+
+// ContainerSSH could not connect a jump host on the way to the backend. The jump host is labelled with its address.
+const EJumpHostConnectionFailed = "SSHPROXY_JUMP_HOST_CONNECTION_FAILED"
+
+// The SSH handshake with a jump host failed. This is usually due to misconfigured credentials for the jump host.
+const EJumpHostHandshakeFailed = "SSHPROXY_JUMP_HOST_HANDSHAKE_FAILED"
+
+// ContainerSSH could not start the proxy command to connect the backend. This is usually because the command does not
+// exist, one of its arguments is an invalid template, or the username would be an unsafe argument.
+const EProxyCommandFailed = "SSHPROXY_PROXY_COMMAND_FAILED"
+
+// The proxy command wrote to its error output. This message is logged on the debug level.
+const MProxyCommandOutput = "SSHPROXY_PROXY_COMMAND_OUTPUT"
+
+// The upstream proxy could not be connected, rejected the credentials, or failed for another reason than not being
+// able to reach the backend. Backends the proxy cannot reach are reported with SSHPROXY_BACKEND_FAILED.
+const EUpstreamProxyFailed = "SSHPROXY_UPSTREAM_PROXY_FAILED"
+
+// The backend rejected the credentials. With authentication pass-through these are the credentials the user provided,
+// usually with a mistyped password. Otherwise the credentials to the backend are usually misconfigured. The connection
+// is neither retried nor sent to a fallback backend so the credentials are not tried more than once.
+const EBackendAuthFailed = "SSHPROXY_BACKEND_AUTH_FAILED"
+
 // ContainerSSH encountered an unexpected host key fingerprint on the backend while trying to proxy the connection.
 // This is either due to a misconfiguration (not all host keys are listed), or a MITM attack between ContainerSSH and
 // the target server.
 const EInvalidFingerprint = "SSHPROXY_INVALID_FINGERPRINT"
 
+// The backing server presented a host certificate that is not acceptable. The certificate may be expired, not list the
+// configured server as a principal, or be signed by an untrusted CA.
+const EInvalidHostCertificate = "SSHPROXY_INVALID_HOST_CERTIFICATE"
+
+// The backing server presented a host key that is marked as revoked.
+const EHostKeyRevoked = "SSHPROXY_HOST_KEY_REVOKED"
+
+// The backing server presented a host key that differs from the ones recorded in the host key store. This is either
+// due to the backing server being reinstalled, or a MITM attack between ContainerSSH and the target server.
+const EHostKeyChanged = "SSHPROXY_HOST_KEY_CHANGED"
+
+// ContainerSSH could not read or update the host key store used for trust on first use.
+const EHostKeyStoreFailed = "SSHPROXY_HOST_KEY_STORE_FAILED"
+
+// ContainerSSH recorded the host key of a backing server it connected for the first time.
+const MHostKeyRecorded = "SSHPROXY_HOST_KEY_RECORDED"
+
+// ContainerSSH stored a new host key the backing server announced and proved to hold.
+const MHostKeysUpdated = "SSHPROXY_HOST_KEYS_UPDATED"
+
+// ContainerSSH could not process the host keys announced by the backing server. The new keys are not stored, the
+// connection is not affected.
+const EHostKeysUpdateFailed = "SSHPROXY_HOST_KEYS_UPDATE_FAILED"
+
 // The client tried to perform an operation after the program has already been started which can only be performed
 // before the program is started.
 const EProgramAlreadyStarted = "SSHPROXY_PROGRAM_ALREADY_STARTED"
@@ -109,3 +172,18 @@ const MBackendDisconnected = "SSHPROXY_BACKEND_DISCONNECTED"
 const MStderrComplete = "SSHPROXY_STDERR_COMPLETE"
 
 const MStdoutComplete = "SSHPROXY_STDOUT_COMPLETE"
+
+// ContainerSSH could not offer the configured agent keys to the backend. This may be because the backend server has
+// agent forwarding disabled.
+const EAgentForwardingFailed = "SSHPROXY_AGENT_FORWARDING_FAILED"
+
+// ContainerSSH could not issue a user certificate for the backend connection. This is most likely due to an unsupported
+// certificate authority key.
+const ECertificateIssueFailed = "SSHPROXY_CERTIFICATE_ISSUE_FAILED"
+
+// The private key for the backend could not be decrypted because the passphrase is missing or incorrect.
+const EPrivateKeyPassphraseInvalid = "SSHPROXY_PRIVATE_KEY_PASSPHRASE_INVALID"
+
+// The private key for the backend could not be parsed. This is usually because the key is malformed or in an
+// unsupported format.
+const EPrivateKeyInvalid = "SSHPROXY_PRIVATE_KEY_INVALID"
@@ -0,0 +1,157 @@
+package sshproxy_test
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/containerssh/sshproxy"
+)
+
+// startDroppingListener starts a listener that closes the first drops connections before the SSH version exchange and
+// forwards the following ones to the backend. If backend is nil all connections are closed.
+func startDroppingListener(t *testing.T, backend *testBackend, drops int32) *net.TCPAddr {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen (%v)", err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	var connections int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if backend == nil || atomic.AddInt32(&connections, 1) <= drops {
+				_ = conn.Close()
+				continue
+			}
+			backendConn, err := net.Dial("tcp", backend.listener.Addr().String())
+			if err != nil {
+				_ = conn.Close()
+				continue
+			}
+			go pipeConnections(conn, backendConn)
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr)
+}
+
+func TestFailover(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen (%v)", err)
+	}
+	deadAddr := listener.Addr().(*net.TCPAddr)
+	_ = listener.Close()
+
+	droppingAddr := startDroppingListener(t, nil, 0)
+	backend := startHostKeyTestBackend(t)
+
+	config := backend.config()
+	fallback := backend.config()
+	config.Server = deadAddr.IP.String()
+	config.Port = uint16(deadAddr.Port)
+	config.Fallbacks = []sshproxy.Backend{
+		{Server: droppingAddr.IP.String(), Port: uint16(droppingAddr.Port)},
+		{Server: fallback.Server, Port: fallback.Port},
+	}
+
+	start := time.Now()
+	if err := connectHostKeyTestBackend(t, config); err != nil {
+		t.Fatalf("failed to fail over to the fallback backend (%v)", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("failing over took too long: %s", elapsed)
+	}
+}
+
+// TestNoFailoverWithCredentials checks that credentials are never tried against more than one backend.
+func TestNoFailoverWithCredentials(t *testing.T) {
+	startPasswordBackend := func(accept bool, attempts *int32) *testBackend {
+		return startTestBackend(
+			t,
+			&ssh.ServerConfig{
+				PasswordCallback: func(_ ssh.ConnMetadata, _ []byte) (*ssh.Permissions, error) {
+					atomic.AddInt32(attempts, 1)
+					if accept {
+						return nil, nil
+					}
+					return nil, fmt.Errorf("invalid credentials")
+				},
+			},
+			func(conn *ssh.ServerConn, channels <-chan ssh.NewChannel, requests <-chan *ssh.Request) {
+				go ssh.DiscardRequests(requests)
+				rejectChannels(channels)
+			},
+		)
+	}
+
+	for name, testCase := range map[string]struct {
+		passThrough  bool
+		dropPrimary  bool
+		expectedCode string
+	}{
+		"configured-password-rejected": {
+			expectedCode: sshproxy.EBackendAuthFailed,
+		},
+		"pass-through-password-rejected": {
+			passThrough:  true,
+			expectedCode: sshproxy.EBackendAuthFailed,
+		},
+		"pass-through-handshake-failed": {
+			passThrough:  true,
+			dropPrimary:  true,
+			expectedCode: sshproxy.EBackendHandshakeFailed,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var primaryAttempts, fallbackAttempts int32
+			primary := startPasswordBackend(false, &primaryAttempts)
+			fallback := startPasswordBackend(true, &fallbackAttempts)
+
+			config := primary.config()
+			if testCase.dropPrimary {
+				droppingAddr := startDroppingListener(t, nil, 0)
+				config.Port = uint16(droppingAddr.Port)
+			}
+			fallbackConfig := fallback.config()
+			config.Fallbacks = []sshproxy.Backend{{Server: fallbackConfig.Server, Port: fallbackConfig.Port}}
+			config.AllowedHostKeyFingerprints = append(config.AllowedHostKeyFingerprints, fallback.fingerprint)
+			config.Retry.RetryOn = []sshproxy.RetryCondition{
+				sshproxy.RetryOnConnectionFailure,
+				sshproxy.RetryOnHandshakeFailure,
+			}
+			config.Retry.MaxAttempts = 3
+			config.Retry.InitialDelay = 10 * time.Millisecond
+
+			config.AuthenticationPassThrough = testCase.passThrough
+			config.UsernamePassThrough = testCase.passThrough
+			proxy, err := newTestProxy(t, config)
+			if err != nil {
+				t.Fatalf("failed to create proxy (%v)", err)
+			}
+			defer proxy.OnDisconnect()
+			if testCase.passThrough {
+				_, err = proxy.OnAuthPassword("test", []byte("invalid"))
+			} else {
+				_, err = proxy.OnHandshakeSuccess("test")
+			}
+
+			assertErrorCode(t, err, testCase.expectedCode)
+			if n := atomic.LoadInt32(&fallbackAttempts); n != 0 {
+				t.Fatalf("the credentials were tried %d times against the fallback backend", n)
+			}
+			if n := atomic.LoadInt32(&primaryAttempts); !testCase.dropPrimary && n != 1 {
+				t.Fatalf("the credentials were tried %d times against the primary backend", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package sshproxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// fileHostKeyStoreLock serializes access to host key store files since every connection uses its own store instance.
+var fileHostKeyStoreLock = &sync.Mutex{}
+
+type fileHostKeyStore struct {
+	file string
+}
+
+func (f *fileHostKeyStore) Get(address string) ([]ssh.PublicKey, error) {
+	fileHostKeyStoreLock.Lock()
+	defer fileHostKeyStoreLock.Unlock()
+	return f.get(knownhosts.Normalize(address))
+}
+
+func (f *fileHostKeyStore) Add(address string, key ssh.PublicKey) error {
+	fileHostKeyStoreLock.Lock()
+	defer fileHostKeyStoreLock.Unlock()
+	host := knownhosts.Normalize(address)
+	keys, err := f.get(host)
+	if err != nil {
+		return err
+	}
+	for _, existingKey := range keys {
+		if bytes.Equal(existingKey.Marshal(), key.Marshal()) {
+			return nil
+		}
+	}
+	return f.add(host, key)
+}
+
+func (f *fileHostKeyStore) AddFirst(address string, key ssh.PublicKey) (bool, error) {
+	fileHostKeyStoreLock.Lock()
+	defer fileHostKeyStoreLock.Unlock()
+	host := knownhosts.Normalize(address)
+	keys, err := f.get(host)
+	if err != nil {
+		return false, err
+	}
+	if len(keys) > 0 {
+		return containsKey(keys, key), nil
+	}
+	return true, f.add(host, key)
+}
+
+func (f *fileHostKeyStore) add(host string, key ssh.PublicKey) error {
+	fh, err := os.OpenFile(f.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open host key store %s (%w)", f.file, err)
+	}
+	if _, err := fh.WriteString(knownhosts.Line([]string{host}, key) + "\n"); err != nil {
+		_ = fh.Close()
+		return fmt.Errorf("failed to write host key store %s (%w)", f.file, err)
+	}
+	if err := fh.Close(); err != nil {
+		return fmt.Errorf("failed to close host key store %s (%w)", f.file, err)
+	}
+	return nil
+}
+
+func (f *fileHostKeyStore) get(host string) ([]ssh.PublicKey, error) {
+	data, err := ioutil.ReadFile(f.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read host key store %s (%w)", f.file, err)
+	}
+	var keys []ssh.PublicKey
+	for len(data) > 0 {
+		var hosts []string
+		var key ssh.PublicKey
+		_, hosts, key, _, data, err = ssh.ParseKnownHosts(data)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse host key store %s (%w)", f.file, err)
+		}
+		for _, h := range hosts {
+			if h == host {
+				keys = append(keys, key)
+				break
+			}
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,163 @@
+package sshproxy_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/containerssh/metrics"
+
+	"github.com/containerssh/sshproxy"
+)
+
+// lockedGauge serializes setting the gauge with reading the collector, which the collector does not do itself.
+type lockedGauge struct {
+	metrics.SimpleGauge
+	lock *sync.Mutex
+}
+
+func (g *lockedGauge) Set(value float64, labels ...metrics.MetricLabel) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.SimpleGauge.Set(value, labels...)
+}
+
+func waitForBackendHealth(t *testing.T, collector metrics.Collector, lock *sync.Mutex, expected float64) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for {
+		lock.Lock()
+		values := collector.GetMetric("backend_health")
+		lock.Unlock()
+		if len(values) == 1 && values[0].Value == expected {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("timeout while waiting for the backend health to become %f (%v)", expected, values)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	backend := startHostKeyTestBackend(t)
+	collector := newTestCollector(t)
+	config := backend.config()
+	config.HealthCheck.Interval = 20 * time.Millisecond
+	config.HealthCheck.FailureThreshold = 1
+	lock := &sync.Mutex{}
+	config.BackendHealthMetric = &lockedGauge{
+		SimpleGauge: collector.MustCreateGauge("backend_health", "", ""),
+		lock:        lock,
+	}
+
+	// The health check only runs while a connection uses the backend.
+	proxy, err := newTestProxy(t, config)
+	if err != nil {
+		t.Fatalf("failed to create proxy (%v)", err)
+	}
+	defer proxy.OnDisconnect()
+	if _, err := proxy.OnHandshakeSuccess("test"); err != nil {
+		t.Fatalf("failed to connect healthy backend (%v)", err)
+	}
+	waitForBackendHealth(t, collector, lock, 1)
+
+	_ = backend.listener.Close()
+	waitForBackendHealth(t, collector, lock, 0)
+
+	start := time.Now()
+	assertErrorCode(t, connectHostKeyTestBackend(t, config), sshproxy.EBackendUnhealthy)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("refusing the unhealthy backend took too long: %s", elapsed)
+	}
+}
+
+func TestHealthCheckWithoutConnections(t *testing.T) {
+	// The backend accepts and closes connections, so the health check fails.
+	var connections int32
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen (%v)", err)
+	}
+	defer func() {
+		_ = listener.Close()
+	}()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&connections, 1)
+			_ = conn.Close()
+		}
+	}()
+
+	collector := newTestCollector(t)
+	config := startHostKeyTestBackend(t).config()
+	config.Port = uint16(listener.Addr().(*net.TCPAddr).Port)
+	config.HealthCheck.Interval = time.Minute
+	config.HealthCheck.FailureThreshold = 1
+	lock := &sync.Mutex{}
+	config.BackendHealthMetric = &lockedGauge{
+		SimpleGauge: collector.MustCreateGauge("backend_health", "", ""),
+		lock:        lock,
+	}
+
+	proxy, err := newTestProxy(t, config)
+	if err != nil {
+		t.Fatalf("failed to create proxy (%v)", err)
+	}
+	waitForBackendHealth(t, collector, lock, 0)
+	proxy.OnDisconnect()
+
+	// No connection uses the backend now, the next one must be refused without connecting or probing the backend.
+	start := time.Now()
+	assertErrorCode(t, connectHostKeyTestBackend(t, config), sshproxy.EBackendUnhealthy)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("refusing the unhealthy backend took too long: %s", elapsed)
+	}
+	if n := atomic.LoadInt32(&connections); n != 1 {
+		t.Fatalf("unexpected number of connections to the unhealthy backend: %d", n)
+	}
+}
+
+// TestHealthCheckPerPath checks that connections reaching the same backend in different ways do not share the health
+// check.
+func TestHealthCheckPerPath(t *testing.T) {
+	backend := startHostKeyTestBackend(t)
+	closedListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen (%v)", err)
+	}
+	closedAddress := closedListener.Addr().String()
+	_ = closedListener.Close()
+
+	collector := newTestCollector(t)
+	config := backend.config()
+	config.HealthCheck.Interval = 20 * time.Millisecond
+	config.HealthCheck.FailureThreshold = 1
+	proxiedConfig := config
+	proxiedConfig.UpstreamProxy = "http://" + closedAddress
+	lock := &sync.Mutex{}
+	proxiedConfig.BackendHealthMetric = &lockedGauge{
+		SimpleGauge: collector.MustCreateGauge("backend_health", "", ""),
+		lock:        lock,
+	}
+
+	// The backend cannot be reached through the upstream proxy.
+	proxy, err := newTestProxy(t, proxiedConfig)
+	if err != nil {
+		t.Fatalf("failed to create proxy (%v)", err)
+	}
+	defer proxy.OnDisconnect()
+	waitForBackendHealth(t, collector, lock, 0)
+
+	if err := connectHostKeyTestBackend(t, config); err != nil {
+		t.Fatalf("failed to connect the backend directly (%v)", err)
+	}
+}
@@ -0,0 +1,239 @@
+package sshproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/containerssh/log"
+	"github.com/containerssh/metrics"
+	"golang.org/x/crypto/ssh"
+)
+
+// backendStateRetention is how long the state of a backend no connection uses is kept, such as its last known health.
+const backendStateRetention = time.Hour
+
+// healthCheckers holds the running health checks by healthCheckKey. The health checks are started by the first
+// connection using the backend and stopped when the last connection using it disconnects.
+var healthCheckers = map[string]*healthChecker{}
+var healthCheckersLock = &sync.Mutex{}
+
+// healthStates holds the last known health of backends whose health check is stopped. A restarted health check
+// continues from this state, so an unhealthy backend is not considered healthy again just because no connection used
+// it for a while.
+var healthStates = map[string]healthState{}
+
+type healthState struct {
+	failures int
+	healthy  bool
+	probed   time.Time
+}
+
+// healthChecker periodically probes a single backend.
+type healthChecker struct {
+	lock     *sync.Mutex
+	key      string
+	address  string
+	config   Config
+	dialer   *backendDialer
+	logger   log.Logger
+	metric   metrics.SimpleGauge
+	failures int
+	healthy  bool
+	probed   time.Time
+	users    int
+	stopped  bool
+	stop     chan struct{}
+}
+
+// getHealthCheckers returns the health checks for all backends of the configuration, starting the ones not yet
+// running. It returns nil if the health check is disabled.
+func getHealthCheckers(config Config, dialer *backendDialer, logger log.Logger) map[string]*healthChecker {
+	if config.HealthCheck.Interval == 0 {
+		return nil
+	}
+	healthCheckersLock.Lock()
+	defer healthCheckersLock.Unlock()
+	result := map[string]*healthChecker{}
+	addresses := append(config.backendAddresses(), config.fallbackAddresses("")...)
+	for _, address := range addresses {
+		key := healthCheckKey(config, address)
+		checker, ok := healthCheckers[key]
+		if !ok {
+			checker = &healthChecker{
+				lock:    &sync.Mutex{},
+				key:     key,
+				address: address,
+				config:  config,
+				dialer:  dialer.withoutConnection(),
+				logger:  logger.WithLabel("backend", address),
+				metric:  config.BackendHealthMetric,
+				healthy: true,
+				stop:    make(chan struct{}),
+			}
+			if state, ok := healthStates[key]; ok {
+				checker.failures = state.failures
+				checker.healthy = state.healthy
+				checker.probed = state.probed
+				delete(healthStates, key)
+			}
+			healthCheckers[key] = checker
+			// A restarted health check keeps the interval instead of probing on every new connection.
+			go checker.run(time.Until(checker.probed.Add(config.HealthCheck.Interval)))
+		}
+		if _, ok := result[address]; !ok {
+			checker.users++
+		}
+		result[address] = checker
+	}
+	return result
+}
+
+// healthCheckKey identifies the health check of the backend address by the options used to probe it, so connections
+// reaching the same backend through different jump hosts, proxies, or timeouts each probe their own path.
+func healthCheckKey(config Config, address string) string {
+	// The options are plain data that always encode.
+	key, _ := json.Marshal(struct {
+		Address           string
+		JumpHosts         []JumpHostConfig
+		ProxyCommand      []string
+		UpstreamProxy     string
+		ProxyProtocol     ProxyProtocolVersion
+		HealthCheck       HealthCheckConfig
+		KexAlgorithms     []string
+		Ciphers           []string
+		MACs              []string
+		HostKeyAlgorithms []string
+		ClientVersion     ClientVersion
+	}{
+		Address:           address,
+		JumpHosts:         config.JumpHosts,
+		ProxyCommand:      config.ProxyCommand,
+		UpstreamProxy:     config.UpstreamProxy,
+		ProxyProtocol:     config.ProxyProtocol,
+		HealthCheck:       config.HealthCheck,
+		KexAlgorithms:     config.KexAlgorithms.StringList(),
+		Ciphers:           config.Ciphers.StringList(),
+		MACs:              config.MACs.StringList(),
+		HostKeyAlgorithms: config.HostKeyAlgorithms.StringList(),
+		ClientVersion:     config.ClientVersion,
+	})
+	return string(key)
+}
+
+// releaseHealthCheckers stops the health checks no longer used by any connection and keeps their last known state.
+func releaseHealthCheckers(checkers map[string]*healthChecker) {
+	healthCheckersLock.Lock()
+	defer healthCheckersLock.Unlock()
+	for key, state := range healthStates {
+		if time.Since(state.probed) > backendStateRetention {
+			delete(healthStates, key)
+		}
+	}
+	for _, checker := range checkers {
+		checker.users--
+		if checker.users > 0 {
+			continue
+		}
+		delete(healthCheckers, checker.key)
+		checker.lock.Lock()
+		checker.stopped = true
+		if !checker.probed.IsZero() {
+			healthStates[checker.key] = healthState{
+				failures: checker.failures,
+				healthy:  checker.healthy,
+				probed:   checker.probed,
+			}
+		}
+		checker.lock.Unlock()
+		close(checker.stop)
+	}
+}
+
+// isHealthy returns false if the backend failed the configured number of consecutive health checks.
+func (h *healthChecker) isHealthy() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.healthy
+}
+
+func (h *healthChecker) run(delay time.Duration) {
+	for {
+		if delay > 0 {
+			select {
+			case <-h.stop:
+				return
+			case <-time.After(delay):
+			}
+		}
+		h.update(h.probe())
+		delay = h.config.HealthCheck.Interval
+	}
+}
+
+func (h *healthChecker) update(err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.stopped {
+		return
+	}
+	h.probed = time.Now()
+	if err == nil {
+		h.failures = 0
+		if !h.healthy {
+			h.logger.Info(log.NewMessage(MBackendHealthy, "Backend %s passed the health check.", h.address))
+		}
+		h.healthy = true
+	} else {
+		h.failures++
+		h.logger.Debug(log.Wrap(err, EBackendUnhealthy, "Backend %s failed the health check.", h.address))
+		if h.healthy && h.failures >= h.config.HealthCheck.FailureThreshold {
+			h.logger.Warning(log.Wrap(err, EBackendUnhealthy, "Backend %s is unhealthy.", h.address))
+			h.healthy = false
+		}
+	}
+	if h.metric != nil {
+		value := 0.0
+		if h.healthy {
+			value = 1.0
+		}
+		h.metric.Set(value, metrics.Label("backend", h.address))
+	}
+}
+
+// probe connects the backend and performs the SSH version exchange and key exchange.
+func (h *healthChecker) probe() error {
+	ctx, cancelFunc := context.WithTimeout(context.Background(), h.config.HealthCheck.Timeout)
+	defer cancelFunc()
+	tcpConn, err := h.dialer.dial(ctx, h.address, "")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tcpConn.Close()
+	}()
+	stopTimeout := closeOnCancel(ctx, tcpConn)
+	defer stopTimeout()
+	// The host key callback runs once the key exchange is complete, so the connection is aborted there.
+	kexComplete := false
+	_, _, _, err = ssh.NewClientConn(tcpConn, h.address, &ssh.ClientConfig{
+		Config: ssh.Config{
+			KeyExchanges: h.config.KexAlgorithms.StringList(),
+			Ciphers:      h.config.Ciphers.StringList(),
+			MACs:         h.config.MACs.StringList(),
+		},
+		ClientVersion:     h.config.ClientVersion.String(),
+		HostKeyAlgorithms: h.config.HostKeyAlgorithms.StringList(),
+		HostKeyCallback: func(_ string, _ net.Addr, _ ssh.PublicKey) error {
+			kexComplete = true
+			return fmt.Errorf("health check complete")
+		},
+	})
+	if kexComplete {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,142 @@
+package sshproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/containerssh/log"
+	"golang.org/x/crypto/ssh"
+)
+
+// handleBackendGlobalRequests processes the host key announcements of the backend and passes all other global
+// requests on to the SSH client.
+func (s *networkConnectionHandler) handleBackendGlobalRequests(
+	sshConn ssh.Conn,
+	target string,
+	requests <-chan *ssh.Request,
+	clientRequests chan<- *ssh.Request,
+) {
+	defer close(clientRequests)
+	for request := range requests {
+		if request.Type != "hostkeys-00@openssh.com" {
+			clientRequests <- request
+			continue
+		}
+		if request.WantReply {
+			_ = request.Reply(true, nil)
+		}
+		go s.updateHostKeys(sshConn, target, request.Payload)
+	}
+}
+
+// updateHostKeys asks the backend to prove it holds the private keys for the announced host keys that are not yet
+// stored, and stores the keys for which a valid proof was received.
+func (s *networkConnectionHandler) updateHostKeys(sshConn ssh.Conn, target string, payload []byte) {
+	blobs, err := parseStringList(payload)
+	if err != nil {
+		s.logger.Debug(log.Wrap(err, EHostKeysUpdateFailed, "Failed to decode host key announcement from backend."))
+		return
+	}
+	storedKeys, err := s.hostKeyVerifier.store.Get(target)
+	if err != nil {
+		s.logger.Warning(log.Wrap(err, EHostKeysUpdateFailed, "Failed to read the host key store."))
+		return
+	}
+	var newKeys []ssh.PublicKey
+	var newBlobs [][]byte
+	for _, blob := range blobs {
+		key, err := ssh.ParsePublicKey(blob)
+		if err != nil {
+			// Unsupported key types are skipped, just like OpenSSH does.
+			continue
+		}
+		if !containsKey(storedKeys, key) {
+			newKeys = append(newKeys, key)
+			newBlobs = append(newBlobs, blob)
+		}
+	}
+	if len(newKeys) == 0 {
+		return
+	}
+
+	ok, response, err := sshConn.SendRequest("hostkeys-prove-00@openssh.com", true, marshalStringList(newBlobs))
+	if err != nil || !ok {
+		s.logger.Debug(log.NewMessage(EHostKeysUpdateFailed, "Backend did not prove the ownership of its host keys."))
+		return
+	}
+	signatures, err := parseStringList(response)
+	if err != nil || len(signatures) != len(newKeys) {
+		s.logger.Warning(log.NewMessage(EHostKeysUpdateFailed, "Backend sent an invalid host key proof."))
+		return
+	}
+	for i, key := range newKeys {
+		signature := &ssh.Signature{}
+		if err := ssh.Unmarshal(signatures[i], signature); err != nil {
+			s.logger.Warning(log.Wrap(err, EHostKeysUpdateFailed, "Backend sent an invalid host key proof."))
+			return
+		}
+		data := marshalStringList([][]byte{
+			[]byte("hostkeys-prove-00@openssh.com"),
+			sshConn.SessionID(),
+			newBlobs[i],
+		})
+		if err := key.Verify(data, signature); err != nil {
+			s.logger.Warning(log.Wrap(err, EHostKeysUpdateFailed, "Backend sent an invalid host key proof."))
+			return
+		}
+	}
+	for _, key := range newKeys {
+		fingerprint := ssh.FingerprintSHA256(key)
+		if err := s.hostKeyVerifier.store.Add(target, key); err != nil {
+			s.logger.Warning(log.Wrap(err, EHostKeysUpdateFailed, "Failed to store the host key %s.", fingerprint))
+			return
+		}
+		s.logger.Info(
+			log.NewMessage(
+				MHostKeysUpdated,
+				"Stored new host key %s announced by the backend.",
+				fingerprint,
+			).Label("fingerprint", fingerprint),
+		)
+	}
+}
+
+func containsKey(keys []ssh.PublicKey, key ssh.PublicKey) bool {
+	for _, k := range keys {
+		if bytes.Equal(k.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseStringList decodes a payload consisting of consecutive SSH strings.
+func parseStringList(payload []byte) ([][]byte, error) {
+	var result [][]byte
+	for len(payload) > 0 {
+		if len(payload) < 4 {
+			return nil, fmt.Errorf("truncated string length")
+		}
+		length := binary.BigEndian.Uint32(payload)
+		payload = payload[4:]
+		if uint32(len(payload)) < length {
+			return nil, fmt.Errorf("truncated string")
+		}
+		result = append(result, payload[:length])
+		payload = payload[length:]
+	}
+	return result, nil
+}
+
+// marshalStringList encodes a list of values as consecutive SSH strings.
+func marshalStringList(values [][]byte) []byte {
+	var result []byte
+	for _, value := range values {
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, uint32(len(value)))
+		result = append(result, length...)
+		result = append(result, value...)
+	}
+	return result
+}
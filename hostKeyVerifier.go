@@ -0,0 +1,220 @@
+package sshproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/containerssh/log"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// hostKeyVerifier checks the host key presented by the backing server.
+type hostKeyVerifier struct {
+	fingerprints    AllowedHostKeyFingerprints
+	knownHosts      ssh.HostKeyCallback
+	trustedCAs      []ssh.PublicKey
+	revoked         map[string]bool
+	certChecker     *ssh.CertChecker
+	store           HostKeyStore
+	trustOnFirstUse bool
+	logger          log.Logger
+}
+
+func newHostKeyVerifier(config Config, logger log.Logger) (*hostKeyVerifier, error) {
+	verifier := &hostKeyVerifier{
+		fingerprints:    config.AllowedHostKeyFingerprints,
+		revoked:         map[string]bool{},
+		trustOnFirstUse: config.TrustOnFirstUse,
+		logger:          logger,
+	}
+	for _, fingerprint := range config.RevokedHostKeys {
+		verifier.revoked[fingerprint] = true
+	}
+	for _, trustedCA := range config.TrustedHostCAs {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(trustedCA))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse trusted host CA %s (%w)", trustedCA, err)
+		}
+		verifier.trustedCAs = append(verifier.trustedCAs, key)
+	}
+	verifier.store = config.HostKeyStore
+	if verifier.store == nil && config.HostKeyStoreFile != "" {
+		verifier.store = NewFileHostKeyStore(config.HostKeyStoreFile)
+	}
+	if len(verifier.trustedCAs) > 0 {
+		verifier.certChecker = &ssh.CertChecker{
+			IsHostAuthority: verifier.isHostAuthority,
+		}
+	}
+	if len(config.KnownHostsFiles) > 0 {
+		knownHosts, err := knownhosts.New(config.KnownHostsFiles...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load known hosts files (%w)", err)
+		}
+		verifier.knownHosts = knownHosts
+	}
+	return verifier, nil
+}
+
+// verify accepts the host key if it is a certificate signed by a trusted CA, it is listed in the known hosts files, its
+// fingerprint is allowed, or it is in the host key store. Revoked keys are always rejected.
+func (v *hostKeyVerifier) verify(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	fingerprint := ssh.FingerprintSHA256(key)
+	if v.isRevoked(key) {
+		err := log.UserMessage(
+			EHostKeyRevoked,
+			"SSH service currently unavailable",
+			"revoked host key: %s",
+			fingerprint,
+		).Label("fingerprint", fingerprint)
+		v.logger.Error(err)
+		return err
+	}
+	var certError error
+	if cert, ok := key.(*ssh.Certificate); ok && v.certChecker != nil {
+		certError = v.certChecker.CheckHostKey(hostname, remote, cert)
+		if certError == nil {
+			return nil
+		}
+	}
+	if v.knownHosts != nil {
+		err := v.knownHosts(hostname, remote, key)
+		if err == nil {
+			return nil
+		}
+		var revokedError *knownhosts.RevokedError
+		if errors.As(err, &revokedError) {
+			err := log.WrapUser(
+				err,
+				EHostKeyRevoked,
+				"SSH service currently unavailable",
+				"revoked host key: %s",
+				fingerprint,
+			).Label("fingerprint", fingerprint)
+			v.logger.Error(err)
+			return err
+		}
+	}
+	for _, fp := range v.fingerprints {
+		if fingerprint == fp {
+			return nil
+		}
+	}
+	if v.store != nil {
+		return v.verifyStored(hostname, key, certError)
+	}
+	return v.reject(fingerprint, certError)
+}
+
+// reject returns the error for a host key that is not accepted.
+func (v *hostKeyVerifier) reject(fingerprint string, certError error) error {
+	if certError != nil {
+		err := log.WrapUser(
+			certError,
+			EInvalidHostCertificate,
+			"SSH service currently unavailable",
+			"invalid host certificate: %s",
+			fingerprint,
+		).Label("fingerprint", fingerprint)
+		v.logger.Error(err)
+		return err
+	}
+	err := log.UserMessage(
+		EInvalidFingerprint,
+		"SSH service currently unavailable",
+		"invalid host key fingerprint: %s",
+		fingerprint,
+	).Label("fingerprint", fingerprint)
+	v.logger.Error(err)
+	return err
+}
+
+// verifyStored accepts the key if it is in the host key store. With trust on first use the key is recorded and
+// accepted if no key is stored for the server yet. For host certificates the certified key is stored and compared, so
+// a reissued certificate is still accepted.
+func (v *hostKeyVerifier) verifyStored(hostname string, key ssh.PublicKey, certError error) error {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		key = cert.Key
+	}
+	fingerprint := ssh.FingerprintSHA256(key)
+	keys, err := v.store.Get(hostname)
+	if err != nil {
+		err := log.WrapUser(
+			err,
+			EHostKeyStoreFailed,
+			"SSH service currently unavailable",
+			"failed to read the host key store",
+		)
+		v.logger.Error(err)
+		return err
+	}
+	if containsKey(keys, key) {
+		return nil
+	}
+	if len(keys) == 0 {
+		if !v.trustOnFirstUse {
+			return v.reject(fingerprint, certError)
+		}
+		// Another connection may have recorded a different key since the store was read.
+		stored, err := v.store.AddFirst(hostname, key)
+		if err != nil {
+			err := log.WrapUser(
+				err,
+				EHostKeyStoreFailed,
+				"SSH service currently unavailable",
+				"failed to record the host key",
+			)
+			v.logger.Error(err)
+			return err
+		}
+		if !stored {
+			return v.changed(hostname, fingerprint)
+		}
+		v.logger.Info(
+			log.NewMessage(
+				MHostKeyRecorded,
+				"Recorded host key %s for %s on first use.",
+				fingerprint,
+				hostname,
+			).Label("fingerprint", fingerprint),
+		)
+		return nil
+	}
+	return v.changed(hostname, fingerprint)
+}
+
+// changed returns the error for a key that differs from the keys recorded for the server.
+func (v *hostKeyVerifier) changed(hostname string, fingerprint string) error {
+	changedErr := log.UserMessage(
+		EHostKeyChanged,
+		"SSH service currently unavailable",
+		"the host key of %s has changed to %s since it was recorded",
+		hostname,
+		fingerprint,
+	).Label("fingerprint", fingerprint)
+	v.logger.Error(changedErr)
+	return log.WrapUser(
+		changedErr,
+		EInvalidFingerprint,
+		"SSH service currently unavailable",
+		"invalid host key fingerprint: %s",
+		fingerprint,
+	).Label("fingerprint", fingerprint)
+}
+
+func (v *hostKeyVerifier) isHostAuthority(auth ssh.PublicKey, _ string) bool {
+	return containsKey(v.trustedCAs, auth)
+}
+
+// isRevoked checks if the key, or for certificates the certified key or the signing CA, is listed as revoked.
+func (v *hostKeyVerifier) isRevoked(key ssh.PublicKey) bool {
+	if v.revoked[ssh.FingerprintSHA256(key)] {
+		return true
+	}
+	if cert, ok := key.(*ssh.Certificate); ok {
+		return v.revoked[ssh.FingerprintSHA256(cert.Key)] || v.revoked[ssh.FingerprintSHA256(cert.SignatureKey)]
+	}
+	return false
+}
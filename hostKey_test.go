@@ -0,0 +1,390 @@
+package sshproxy_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/containerssh/log"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/containerssh/sshproxy"
+)
+
+func startHostKeyTestBackend(t *testing.T) *testBackend {
+	return startTestBackend(
+		t,
+		&ssh.ServerConfig{
+			NoClientAuth: true,
+		},
+		func(conn *ssh.ServerConn, channels <-chan ssh.NewChannel, requests <-chan *ssh.Request) {
+			go ssh.DiscardRequests(requests)
+			rejectChannels(channels)
+		},
+	)
+}
+
+func connectHostKeyTestBackend(t *testing.T, config sshproxy.Config) error {
+	proxy, err := newTestProxy(t, config)
+	if err != nil {
+		t.Fatalf("failed to create proxy (%v)", err)
+	}
+	defer proxy.OnDisconnect()
+	_, err = proxy.OnHandshakeSuccess("test")
+	return err
+}
+
+func assertErrorCode(t *testing.T, err error, code string) {
+	var message log.Message
+	if !errors.As(err, &message) {
+		t.Fatalf("expected an error with code %s, got: %v", code, err)
+	}
+	if message.Code() != code {
+		t.Fatalf("expected an error with code %s, got: %s (%v)", code, message.Code(), err)
+	}
+}
+
+func TestKnownHosts(t *testing.T) {
+	backend := startHostKeyTestBackend(t)
+	addr := backend.listener.Addr().String()
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatalf("failed to split backend address (%v)", err)
+	}
+
+	for name, testCase := range map[string]struct {
+		line         string
+		expectedCode string
+	}{
+		"hashed": {
+			line: knownhosts.Line([]string{knownhosts.HashHostname(knownhosts.Normalize(addr))}, backend.hostKey.PublicKey()),
+		},
+		"wildcard": {
+			line: knownhosts.Line([]string{"[127.0.0.*]:" + port}, backend.hostKey.PublicKey()),
+		},
+		"revoked": {
+			line:         "@revoked " + knownhosts.Line([]string{"[" + host + "]:" + port}, backend.hostKey.PublicKey()),
+			expectedCode: sshproxy.EHostKeyRevoked,
+		},
+		"unknown": {
+			line:         knownhosts.Line([]string{"example.com"}, backend.hostKey.PublicKey()),
+			expectedCode: sshproxy.EInvalidFingerprint,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			knownHostsFile := filepath.Join(t.TempDir(), "known_hosts")
+			if err := ioutil.WriteFile(knownHostsFile, []byte(testCase.line+"\n"), 0600); err != nil {
+				t.Fatalf("failed to write known hosts file (%v)", err)
+			}
+			config := backend.config()
+			config.AllowedHostKeyFingerprints = nil
+			config.KnownHostsFiles = []string{knownHostsFile}
+			err := connectHostKeyTestBackend(t, config)
+			if testCase.expectedCode == "" {
+				if err != nil {
+					t.Fatalf("failed to connect backend (%v)", err)
+				}
+				return
+			}
+			assertErrorCode(t, err, testCase.expectedCode)
+		})
+	}
+}
+
+func TestHostCertificate(t *testing.T) {
+	caSigner := generateTestSigner(t)
+	hostSigner := generateTestSigner(t)
+
+	for name, testCase := range map[string]struct {
+		principal    string
+		validBefore  time.Time
+		revoked      bool
+		expectedCode string
+	}{
+		"valid": {
+			principal:   "127.0.0.1",
+			validBefore: time.Now().Add(time.Hour),
+		},
+		"wrong-principal": {
+			principal:    "example.com",
+			validBefore:  time.Now().Add(time.Hour),
+			expectedCode: sshproxy.EInvalidHostCertificate,
+		},
+		"expired": {
+			principal:    "127.0.0.1",
+			validBefore:  time.Now().Add(-time.Minute),
+			expectedCode: sshproxy.EInvalidHostCertificate,
+		},
+		"revoked": {
+			principal:    "127.0.0.1",
+			validBefore:  time.Now().Add(time.Hour),
+			revoked:      true,
+			expectedCode: sshproxy.EHostKeyRevoked,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cert := &ssh.Certificate{
+				Key:             hostSigner.PublicKey(),
+				CertType:        ssh.HostCert,
+				ValidPrincipals: []string{testCase.principal},
+				ValidAfter:      uint64(time.Now().Add(-time.Hour).Unix()),
+				ValidBefore:     uint64(testCase.validBefore.Unix()),
+			}
+			if err := cert.SignCert(rand.Reader, caSigner); err != nil {
+				t.Fatalf("failed to sign host certificate (%v)", err)
+			}
+			certSigner, err := ssh.NewCertSigner(cert, hostSigner)
+			if err != nil {
+				t.Fatalf("failed to create host certificate signer (%v)", err)
+			}
+			serverConfig := &ssh.ServerConfig{
+				NoClientAuth: true,
+			}
+			serverConfig.AddHostKey(certSigner)
+			backend := startTestBackend(
+				t,
+				serverConfig,
+				func(conn *ssh.ServerConn, channels <-chan ssh.NewChannel, requests <-chan *ssh.Request) {
+					go ssh.DiscardRequests(requests)
+					rejectChannels(channels)
+				},
+			)
+
+			config := backend.config()
+			config.AllowedHostKeyFingerprints = nil
+			config.TrustedHostCAs = []string{string(ssh.MarshalAuthorizedKey(caSigner.PublicKey()))}
+			if testCase.revoked {
+				config.RevokedHostKeys = []string{ssh.FingerprintSHA256(caSigner.PublicKey())}
+			}
+			err = connectHostKeyTestBackend(t, config)
+			if testCase.expectedCode == "" {
+				if err != nil {
+					t.Fatalf("failed to connect backend (%v)", err)
+				}
+				return
+			}
+			assertErrorCode(t, err, testCase.expectedCode)
+		})
+	}
+}
+
+func generateTestSigner(t *testing.T) ssh.Signer {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key (%v)", err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatalf("failed to create signer (%v)", err)
+	}
+	return signer
+}
+
+func TestTrustOnFirstUse(t *testing.T) {
+	backend := startHostKeyTestBackend(t)
+	storeFile := filepath.Join(t.TempDir(), "known_hosts")
+	config := backend.config()
+	config.AllowedHostKeyFingerprints = nil
+	config.TrustOnFirstUse = true
+	config.HostKeyStoreFile = storeFile
+
+	if err := connectHostKeyTestBackend(t, config); err != nil {
+		t.Fatalf("failed to connect backend on first use (%v)", err)
+	}
+	if err := connectHostKeyTestBackend(t, config); err != nil {
+		t.Fatalf("failed to connect backend with recorded host key (%v)", err)
+	}
+
+	line := knownhosts.Line(
+		[]string{knownhosts.Normalize(backend.listener.Addr().String())},
+		generateTestSigner(t).PublicKey(),
+	)
+	if err := ioutil.WriteFile(storeFile, []byte(line+"\n"), 0600); err != nil {
+		t.Fatalf("failed to write host key store (%v)", err)
+	}
+	assertErrorCode(t, connectHostKeyTestBackend(t, config), sshproxy.EInvalidFingerprint)
+}
+
+func TestHostKeyStoreAddFirst(t *testing.T) {
+	store := sshproxy.NewFileHostKeyStore(filepath.Join(t.TempDir(), "known_hosts"))
+	keys := make([]ssh.PublicKey, 10)
+	for i := range keys {
+		keys[i] = generateTestSigner(t).PublicKey()
+	}
+
+	var stored int32
+	wg := &sync.WaitGroup{}
+	for _, key := range keys {
+		wg.Add(1)
+		go func(key ssh.PublicKey) {
+			defer wg.Done()
+			ok, err := store.AddFirst("127.0.0.1:22", key)
+			if err != nil {
+				t.Errorf("failed to add host key (%v)", err)
+			}
+			if ok {
+				atomic.AddInt32(&stored, 1)
+			}
+		}(key)
+	}
+	wg.Wait()
+	if stored != 1 {
+		t.Fatalf("%d concurrent first keys were stored", stored)
+	}
+	storedKeys, err := store.Get("127.0.0.1:22")
+	if err != nil {
+		t.Fatalf("failed to read host key store (%v)", err)
+	}
+	if len(storedKeys) != 1 {
+		t.Fatalf("unexpected number of stored keys: %d", len(storedKeys))
+	}
+	if ok, err := store.AddFirst("127.0.0.1:22", storedKeys[0]); err != nil || !ok {
+		t.Fatalf("the stored key was not accepted again (%v)", err)
+	}
+}
+
+func TestUpdateHostKeys(t *testing.T) {
+	newHostKey := generateTestSigner(t)
+	backend := startTestBackend(
+		t,
+		&ssh.ServerConfig{
+			NoClientAuth: true,
+		},
+		func(conn *ssh.ServerConn, channels <-chan ssh.NewChannel, requests <-chan *ssh.Request) {
+			go rejectChannels(channels)
+			go func() {
+				_, _, _ = conn.SendRequest("hostkeys-00@openssh.com", false, marshalTestStrings(newHostKey.PublicKey().Marshal()))
+			}()
+			for request := range requests {
+				if request.Type != "hostkeys-prove-00@openssh.com" {
+					_ = request.Reply(false, nil)
+					continue
+				}
+				signature, err := newHostKey.Sign(rand.Reader, marshalTestStrings(
+					[]byte("hostkeys-prove-00@openssh.com"),
+					conn.SessionID(),
+					newHostKey.PublicKey().Marshal(),
+				))
+				if err != nil {
+					t.Errorf("failed to sign host key proof (%v)", err)
+					_ = request.Reply(false, nil)
+					continue
+				}
+				_ = request.Reply(true, marshalTestStrings(ssh.Marshal(signature)))
+			}
+		},
+	)
+
+	storeFile := filepath.Join(t.TempDir(), "known_hosts")
+	config := backend.config()
+	config.HostKeyStoreFile = storeFile
+	config.UpdateHostKeys = true
+	proxy, err := newTestProxy(t, config)
+	if err != nil {
+		t.Fatalf("failed to create proxy (%v)", err)
+	}
+	defer proxy.OnDisconnect()
+	if _, err := proxy.OnHandshakeSuccess("test"); err != nil {
+		t.Fatalf("failed to connect backend (%v)", err)
+	}
+
+	store := sshproxy.NewFileHostKeyStore(storeFile)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for {
+		keys, err := store.Get(backend.listener.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to read host key store (%v)", err)
+		}
+		if len(keys) == 1 && bytes.Equal(keys[0].Marshal(), newHostKey.PublicKey().Marshal()) {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("timeout while waiting for the new host key to be stored")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func marshalTestStrings(values ...[]byte) []byte {
+	var result []byte
+	for _, value := range values {
+		result = append(result, ssh.Marshal(struct{ Value []byte }{value})...)
+	}
+	return result
+}
+
+// reissuingCertSigner is a host key signer presenting the certificate last stored in cert.
+type reissuingCertSigner struct {
+	ssh.Signer
+	cert atomic.Value
+}
+
+func (r *reissuingCertSigner) PublicKey() ssh.PublicKey {
+	return r.cert.Load().(*ssh.Certificate)
+}
+
+func (r *reissuingCertSigner) issue(t *testing.T, caSigner ssh.Signer) {
+	cert := &ssh.Certificate{
+		Key:             r.Signer.PublicKey(),
+		Serial:          uint64(time.Now().UnixNano()),
+		CertType:        ssh.HostCert,
+		ValidPrincipals: []string{"127.0.0.1"},
+		ValidAfter:      uint64(time.Now().Add(-time.Hour).Unix()),
+		ValidBefore:     uint64(time.Now().Add(time.Hour).Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, caSigner); err != nil {
+		t.Fatalf("failed to sign host certificate (%v)", err)
+	}
+	r.cert.Store(cert)
+}
+
+func TestTrustOnFirstUseHostCertificate(t *testing.T) {
+	caSigner := generateTestSigner(t)
+	hostSigner := &reissuingCertSigner{Signer: generateTestSigner(t)}
+	hostSigner.issue(t, caSigner)
+	serverConfig := &ssh.ServerConfig{
+		NoClientAuth: true,
+	}
+	serverConfig.AddHostKey(hostSigner)
+	backend := startTestBackend(
+		t,
+		serverConfig,
+		func(conn *ssh.ServerConn, channels <-chan ssh.NewChannel, requests <-chan *ssh.Request) {
+			go ssh.DiscardRequests(requests)
+			rejectChannels(channels)
+		},
+	)
+	storeFile := filepath.Join(t.TempDir(), "known_hosts")
+	config := backend.config()
+	config.AllowedHostKeyFingerprints = nil
+	config.TrustOnFirstUse = true
+	config.HostKeyStoreFile = storeFile
+
+	if err := connectHostKeyTestBackend(t, config); err != nil {
+		t.Fatalf("failed to connect backend on first use (%v)", err)
+	}
+	keys, err := sshproxy.NewFileHostKeyStore(storeFile).Get(backend.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to read host key store (%v)", err)
+	}
+	if len(keys) != 1 || !bytes.Equal(keys[0].Marshal(), hostSigner.Signer.PublicKey().Marshal()) {
+		t.Fatalf("the certified host key was not stored (%d keys)", len(keys))
+	}
+
+	hostSigner.issue(t, caSigner)
+	if err := connectHostKeyTestBackend(t, config); err != nil {
+		t.Fatalf("failed to connect backend with a reissued host certificate (%v)", err)
+	}
+}
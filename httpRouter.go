@@ -0,0 +1,118 @@
+package sshproxy
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/containerssh/http"
+	"github.com/containerssh/log"
+	"github.com/containerssh/structutils"
+)
+
+// RoutingRequest is the request sent to the routing webhook.
+type RoutingRequest struct {
+	// Username is the username the client authenticated with.
+	Username string `json:"username" yaml:"username"`
+	// RemoteAddress is the IP address of the client.
+	RemoteAddress string `json:"remoteAddress" yaml:"remoteAddress"`
+	// ConnectionID is the unique identifier of the client connection.
+	ConnectionID string `json:"connectionId" yaml:"connectionId"`
+}
+
+// RoutingResponse is the response expected from the routing webhook.
+type RoutingResponse struct {
+	// Config is the backend configuration for the connection. Options not set in the response take their default
+	// values, not the values from the proxy configuration. Options that run commands or read local files on the proxy,
+	// such as proxyCommand, hostKeyStoreFile, knownHostsFiles, or keys given as file names, are rejected; keys and
+	// certificates must be sent inline. Unix socket backends and fallbacks are rejected as well.
+	Config Config `json:"config" yaml:"config"`
+}
+
+// NewHTTPRouter creates a Router that sends a RoutingRequest to the /route path of the webhook and expects a
+// RoutingResponse.
+func NewHTTPRouter(config http.ClientConfiguration, logger log.Logger) (Router, error) {
+	client, err := http.NewClient(config, logger)
+	if err != nil {
+		return nil, err
+	}
+	return &httpRouter{
+		client: client,
+	}, nil
+}
+
+type httpRouter struct {
+	client http.Client
+}
+
+func (h *httpRouter) Route(username string, client net.TCPAddr, connectionID string) (Config, error) {
+	request := RoutingRequest{
+		Username:      username,
+		RemoteAddress: client.IP.String(),
+		ConnectionID:  connectionID,
+	}
+	response := RoutingResponse{}
+	structutils.Defaults(&response.Config)
+	statusCode, err := h.client.Post("/route", request, &response)
+	if err != nil {
+		return Config{}, err
+	}
+	if statusCode != 200 {
+		return Config{}, fmt.Errorf("invalid status code from routing webhook: %d", statusCode)
+	}
+	if err := checkRoutingResponse(response.Config); err != nil {
+		return Config{}, fmt.Errorf("invalid configuration from routing webhook (%w)", err)
+	}
+	return response.Config, nil
+}
+
+// checkRoutingResponse rejects the options a routing webhook may not set because they run commands or access files,
+// sockets, and environment variables on the proxy.
+func checkRoutingResponse(config Config) error {
+	if len(config.ProxyCommand) > 0 {
+		return fmt.Errorf("proxyCommand cannot be set")
+	}
+	if config.hasUnixSocketBackend() {
+		return fmt.Errorf("unix socket backends cannot be set")
+	}
+	if config.HostKeyStoreFile != "" {
+		return fmt.Errorf("hostKeyStoreFile cannot be set")
+	}
+	if len(config.KnownHostsFiles) > 0 {
+		return fmt.Errorf("knownHostsFiles cannot be set")
+	}
+	if config.PrivateKeyPassphraseEnv != "" || config.PrivateKeyPassphraseFile != "" {
+		return fmt.Errorf("privateKeyPassphraseEnv and privateKeyPassphraseFile cannot be set")
+	}
+	ca := config.CertificateAuthority
+	if ca.PrivateKeyPassphraseEnv != "" || ca.PrivateKeyPassphraseFile != "" {
+		return fmt.Errorf("certificateAuthority.privateKeyPassphraseEnv and privateKeyPassphraseFile cannot be set")
+	}
+	keys := map[string][]string{
+		"privateKey":                      {config.PrivateKey},
+		"privateKeys":                     config.PrivateKeys,
+		"agentKeys":                       config.AgentKeys,
+		"certificateAuthority.privateKey": {ca.PrivateKey},
+	}
+	for i, jumpHost := range config.JumpHosts {
+		if len(jumpHost.KnownHostsFiles) > 0 {
+			return fmt.Errorf("jumpHosts[%d].knownHostsFiles cannot be set", i)
+		}
+		if jumpHost.PrivateKeyPassphraseEnv != "" || jumpHost.PrivateKeyPassphraseFile != "" {
+			return fmt.Errorf("jumpHosts[%d].privateKeyPassphraseEnv and privateKeyPassphraseFile cannot be set", i)
+		}
+		keys[fmt.Sprintf("jumpHosts[%d].privateKey", i)] = []string{jumpHost.PrivateKey}
+	}
+	for option, values := range keys {
+		for _, value := range values {
+			if value != "" && !isInlineKey(value) {
+				return fmt.Errorf("%s must contain the key in PEM format, not a file name", option)
+			}
+		}
+	}
+	for _, certificate := range config.Certificates {
+		if !isInlineCertificate(certificate) {
+			return fmt.Errorf("certificates must contain the certificate in authorized_keys format, not a file name")
+		}
+	}
+	return nil
+}
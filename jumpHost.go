@@ -0,0 +1,105 @@
+package sshproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/containerssh/log"
+	"golang.org/x/crypto/ssh"
+)
+
+// jumpHost is a jump host with its credentials and host key verification loaded.
+type jumpHost struct {
+	index           int
+	address         string
+	clientConfig    *ssh.ClientConfig
+	hostKeyVerifier *hostKeyVerifier
+}
+
+func newJumpHost(index int, jumpHostConfig JumpHostConfig, config Config, logger log.Logger) (*jumpHost, error) {
+	address := jumpHostConfig.address()
+	logger = logger.WithLabel("jumpHost", address)
+	verifier, err := newHostKeyVerifier(
+		Config{
+			AllowedHostKeyFingerprints: jumpHostConfig.AllowedHostKeyFingerprints,
+			KnownHostsFiles:            jumpHostConfig.KnownHostsFiles,
+		},
+		logger,
+	)
+	if err != nil {
+		return nil, err
+	}
+	var authMethods []ssh.AuthMethod
+	if jumpHostConfig.PrivateKey != "" {
+		passphrase, err := loadPassphrase(
+			jumpHostConfig.PrivateKeyPassphrase,
+			jumpHostConfig.PrivateKeyPassphraseEnv,
+			jumpHostConfig.PrivateKeyPassphraseFile,
+		)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := loadPrivateKey(jumpHostConfig.PrivateKey, passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the private key of jump host %d (%w)", index+1, err)
+		}
+		authMethods = append(authMethods, ssh.PublicKeys(signer))
+	}
+	if jumpHostConfig.Password != "" {
+		authMethods = append(authMethods, ssh.Password(jumpHostConfig.Password))
+	}
+	return &jumpHost{
+		index:   index,
+		address: address,
+		clientConfig: &ssh.ClientConfig{
+			Config: ssh.Config{
+				KeyExchanges: config.KexAlgorithms.StringList(),
+				Ciphers:      config.Ciphers.StringList(),
+				MACs:         config.MACs.StringList(),
+			},
+			User:              jumpHostConfig.Username,
+			Auth:              authMethods,
+			ClientVersion:     config.ClientVersion.String(),
+			HostKeyAlgorithms: config.HostKeyAlgorithms.StringList(),
+		},
+		hostKeyVerifier: verifier,
+	}, nil
+}
+
+// connect performs the SSH handshake with the jump host over conn.
+func (j *jumpHost) connect(ctx context.Context, conn net.Conn) (*ssh.Client, error) {
+	sshConn, newChannels, requests, stage, err := sshHandshake(ctx, conn, j.address, j.clientConfig, j.hostKeyVerifier)
+	if err != nil {
+		if stage == handshakeStageHostKey {
+			return nil, err
+		}
+		return nil, log.WrapUser(
+			err,
+			EJumpHostHandshakeFailed,
+			"SSH service is currently unavailable.",
+			"SSH handshake with jump host %d (%s) failed.",
+			j.index+1,
+			j.address,
+		).Label("jumpHost", j.address)
+	}
+	return ssh.NewClient(sshConn, newChannels, requests), nil
+}
+
+// jumpHostConn is a connection tunneled through jump hosts. Closing it also closes the jump host connections.
+type jumpHostConn struct {
+	net.Conn
+	clients []*ssh.Client
+}
+
+func (j *jumpHostConn) Close() error {
+	err := j.Conn.Close()
+	closeJumpHostClients(j.clients)
+	return err
+}
+
+func closeJumpHostClients(clients []*ssh.Client) {
+	for i := len(clients) - 1; i >= 0; i-- {
+		_ = clients[i].Close()
+	}
+}
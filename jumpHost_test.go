@@ -0,0 +1,209 @@
+package sshproxy_test
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/containerssh/sshproxy"
+)
+
+// startJumpHostTestBackend starts an SSH server that forwards direct-tcpip channels like a jump host.
+func startJumpHostTestBackend(t *testing.T) *testBackend {
+	return startJumpHostTestBackendWith(t, forwardDirectTCPIP)
+}
+
+// startJumpHostTestBackendWith starts a jump host that passes the direct-tcpip channels to handleChannel. Password and
+// public key authentication of the user "jump" is accepted, with the password "jump" or any key.
+func startJumpHostTestBackendWith(t *testing.T, handleChannel func(newChannel ssh.NewChannel)) *testBackend {
+	return startTestBackend(
+		t,
+		&ssh.ServerConfig{
+			PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+				if conn.User() == "jump" && string(password) == "jump" {
+					return nil, nil
+				}
+				return nil, fmt.Errorf("invalid credentials")
+			},
+			PublicKeyCallback: func(conn ssh.ConnMetadata, _ ssh.PublicKey) (*ssh.Permissions, error) {
+				if conn.User() == "jump" {
+					return nil, nil
+				}
+				return nil, fmt.Errorf("invalid credentials")
+			},
+		},
+		func(conn *ssh.ServerConn, channels <-chan ssh.NewChannel, requests <-chan *ssh.Request) {
+			go ssh.DiscardRequests(requests)
+			for newChannel := range channels {
+				if newChannel.ChannelType() != "direct-tcpip" {
+					_ = newChannel.Reject(ssh.UnknownChannelType, "not supported")
+					continue
+				}
+				go handleChannel(newChannel)
+			}
+		},
+	)
+}
+
+func forwardDirectTCPIP(newChannel ssh.NewChannel) {
+	payload := struct {
+		Host     string
+		Port     uint32
+		OrigHost string
+		OrigPort uint32
+	}{}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	targetConn, err := net.Dial("tcp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port))))
+	if err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		_ = targetConn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	go func() {
+		_, _ = io.Copy(targetConn, channel)
+		_ = targetConn.Close()
+	}()
+	_, _ = io.Copy(channel, targetConn)
+	_ = channel.Close()
+}
+
+func jumpHostConfig(backend *testBackend) sshproxy.JumpHostConfig {
+	config := backend.config()
+	return sshproxy.JumpHostConfig{
+		Server:                     config.Server,
+		Port:                       config.Port,
+		Username:                   "jump",
+		Password:                   "jump",
+		AllowedHostKeyFingerprints: []string{backend.fingerprint},
+	}
+}
+
+func TestJumpHosts(t *testing.T) {
+	backend := startHostKeyTestBackend(t)
+	firstJumpHost := startJumpHostTestBackend(t)
+	secondJumpHost := startJumpHostTestBackend(t)
+
+	wrongPassword := jumpHostConfig(secondJumpHost)
+	wrongPassword.Password = "invalid"
+	wrongFingerprint := jumpHostConfig(secondJumpHost)
+	wrongFingerprint.AllowedHostKeyFingerprints = []string{firstJumpHost.fingerprint}
+	deadJumpHost := jumpHostConfig(secondJumpHost)
+	deadJumpHost.Port = 1
+
+	for name, testCase := range map[string]struct {
+		jumpHosts    []sshproxy.JumpHostConfig
+		expectedCode string
+	}{
+		"one": {
+			jumpHosts: []sshproxy.JumpHostConfig{jumpHostConfig(firstJumpHost)},
+		},
+		"two": {
+			jumpHosts: []sshproxy.JumpHostConfig{jumpHostConfig(firstJumpHost), jumpHostConfig(secondJumpHost)},
+		},
+		"wrong-password": {
+			jumpHosts:    []sshproxy.JumpHostConfig{jumpHostConfig(firstJumpHost), wrongPassword},
+			expectedCode: sshproxy.EJumpHostHandshakeFailed,
+		},
+		"wrong-fingerprint": {
+			jumpHosts:    []sshproxy.JumpHostConfig{jumpHostConfig(firstJumpHost), wrongFingerprint},
+			expectedCode: sshproxy.EInvalidFingerprint,
+		},
+		"unreachable": {
+			jumpHosts:    []sshproxy.JumpHostConfig{jumpHostConfig(firstJumpHost), deadJumpHost},
+			expectedCode: sshproxy.EJumpHostConnectionFailed,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			config := backend.config()
+			config.JumpHosts = testCase.jumpHosts
+			config.Retry.MaxAttempts = 1
+			err := connectHostKeyTestBackend(t, config)
+			if testCase.expectedCode == "" {
+				if err != nil {
+					t.Fatalf("failed to connect backend through jump hosts (%v)", err)
+				}
+				return
+			}
+			assertErrorCode(t, err, testCase.expectedCode)
+		})
+	}
+}
+
+func TestJumpHostTimeout(t *testing.T) {
+	backend := startHostKeyTestBackend(t)
+	// The first jump host never answers the request to open a channel to the second one.
+	stalledChannels := make(chan ssh.NewChannel, 1)
+	firstJumpHost := startJumpHostTestBackendWith(t, func(newChannel ssh.NewChannel) {
+		stalledChannels <- newChannel
+	})
+	secondJumpHost := startJumpHostTestBackend(t)
+
+	config := backend.config()
+	config.JumpHosts = []sshproxy.JumpHostConfig{jumpHostConfig(firstJumpHost), jumpHostConfig(secondJumpHost)}
+	config.Retry.MaxAttempts = 1
+	config.Timeout = 500 * time.Millisecond
+
+	start := time.Now()
+	err := connectHostKeyTestBackend(t, config)
+	assertErrorCode(t, err, sshproxy.EJumpHostConnectionFailed)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("the connection attempt did not time out (%s)", elapsed)
+	}
+	select {
+	case <-stalledChannels:
+	default:
+		t.Fatalf("the channel to the second jump host was not requested")
+	}
+}
+
+func TestJumpHostEncryptedPrivateKey(t *testing.T) {
+	backend := startHostKeyTestBackend(t)
+	jumpHost := startJumpHostTestBackend(t)
+
+	for name, testCase := range map[string]struct {
+		passphrase   string
+		expectedCode string
+	}{
+		"correct": {
+			passphrase: "secret",
+		},
+		"missing": {
+			expectedCode: sshproxy.EPrivateKeyPassphraseInvalid,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			hop := jumpHostConfig(jumpHost)
+			hop.Password = ""
+			hop.PrivateKey = encryptedPrivateKey
+			hop.PrivateKeyPassphrase = testCase.passphrase
+			config := backend.config()
+			config.JumpHosts = []sshproxy.JumpHostConfig{hop}
+
+			proxy, err := newTestProxy(t, config)
+			if testCase.expectedCode != "" {
+				assertErrorCode(t, err, testCase.expectedCode)
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to create proxy (%v)", err)
+			}
+			defer proxy.OnDisconnect()
+			if _, err := proxy.OnHandshakeSuccess("test"); err != nil {
+				t.Fatalf("failed to connect backend through the jump host (%v)", err)
+			}
+		})
+	}
+}
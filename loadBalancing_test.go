@@ -0,0 +1,142 @@
+package sshproxy_test
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/containerssh/sshproxy"
+	"github.com/containerssh/sshserver"
+)
+
+func startCountingTestBackend(t *testing.T, connections *int32) *testBackend {
+	return startTestBackend(
+		t,
+		&ssh.ServerConfig{
+			PasswordCallback: func(_ ssh.ConnMetadata, _ []byte) (*ssh.Permissions, error) {
+				atomic.AddInt32(connections, 1)
+				return nil, nil
+			},
+		},
+		func(conn *ssh.ServerConn, channels <-chan ssh.NewChannel, requests <-chan *ssh.Request) {
+			go ssh.DiscardRequests(requests)
+			rejectChannels(channels)
+		},
+	)
+}
+
+func TestLoadBalancing(t *testing.T) {
+	for name, testCase := range map[string]struct {
+		strategy sshproxy.LoadBalancingStrategy
+		keepOpen bool
+		expected [2]int32
+	}{
+		"round-robin": {
+			strategy: sshproxy.LoadBalancingRoundRobin,
+			expected: [2]int32{2, 2},
+		},
+		"least-connections": {
+			strategy: sshproxy.LoadBalancingLeastConnections,
+			keepOpen: true,
+			expected: [2]int32{2, 2},
+		},
+		"consistent-hash": {
+			strategy: sshproxy.LoadBalancingConsistentHash,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var connections [2]int32
+			backends := []*testBackend{
+				startCountingTestBackend(t, &connections[0]),
+				startCountingTestBackend(t, &connections[1]),
+			}
+			config := backends[0].config()
+			config.Server = ""
+			config.AllowedHostKeyFingerprints = []string{backends[0].fingerprint, backends[1].fingerprint}
+			config.LoadBalancing = testCase.strategy
+			for _, backend := range backends {
+				baseConfig := backend.config()
+				config.Backends = append(config.Backends, sshproxy.Backend{
+					Server: baseConfig.Server,
+					Port:   baseConfig.Port,
+				})
+			}
+
+			for i := 0; i < 4; i++ {
+				proxy, err := newTestProxy(t, config)
+				if err != nil {
+					t.Fatalf("failed to create proxy (%v)", err)
+				}
+				if _, err := proxy.OnHandshakeSuccess("test"); err != nil {
+					t.Fatalf("failed to connect backend (%v)", err)
+				}
+				if testCase.keepOpen {
+					defer proxy.OnDisconnect()
+				} else {
+					proxy.OnDisconnect()
+				}
+			}
+
+			distribution := [2]int32{atomic.LoadInt32(&connections[0]), atomic.LoadInt32(&connections[1])}
+			if testCase.strategy == sshproxy.LoadBalancingConsistentHash {
+				if distribution[0] != 0 && distribution[1] != 0 {
+					t.Fatalf("the same user was sent to different backends: %v", distribution)
+				}
+				return
+			}
+			if distribution != testCase.expected {
+				t.Fatalf("unexpected distribution of connections: %v", distribution)
+			}
+		})
+	}
+}
+
+// TestLoadBalancingFallback checks that a connection to a fallback is counted on it when the fallback is also a backend.
+func TestLoadBalancingFallback(t *testing.T) {
+	var connections [2]int32
+	backends := []*testBackend{
+		startCountingTestBackend(t, &connections[0]),
+		startCountingTestBackend(t, &connections[1]),
+	}
+	// The first backend drops the first connection, so it fails over to the second one.
+	droppingAddr := startDroppingListener(t, backends[0], 1)
+	fallback := backends[1].config()
+	config := backends[0].config()
+	config.Server = ""
+	config.AllowedHostKeyFingerprints = []string{backends[0].fingerprint, backends[1].fingerprint}
+	config.LoadBalancing = sshproxy.LoadBalancingLeastConnections
+	config.Retry.MaxAttempts = 1
+	config.Backends = []sshproxy.Backend{
+		{Server: droppingAddr.IP.String(), Port: uint16(droppingAddr.Port)},
+		{Server: fallback.Server, Port: fallback.Port},
+	}
+	config.Fallbacks = []sshproxy.Backend{{Server: fallback.Server, Port: fallback.Port}}
+
+	connect := func() sshserver.NetworkConnectionHandler {
+		proxy, err := newTestProxy(t, config)
+		if err != nil {
+			t.Fatalf("failed to create proxy (%v)", err)
+		}
+		if _, err := proxy.OnHandshakeSuccess("test"); err != nil {
+			t.Fatalf("failed to connect backend (%v)", err)
+		}
+		return proxy
+	}
+	assertDistribution := func(expected [2]int32) {
+		distribution := [2]int32{atomic.LoadInt32(&connections[0]), atomic.LoadInt32(&connections[1])}
+		if distribution != expected {
+			t.Fatalf("unexpected distribution of connections: %v, expected: %v", distribution, expected)
+		}
+	}
+
+	failedOver := connect()
+	assertDistribution([2]int32{0, 1})
+	// The second backend has a connection, so the first one is selected.
+	defer connect().OnDisconnect()
+	assertDistribution([2]int32{1, 1})
+	// Once the connection that failed over is closed, the second backend has fewer connections.
+	failedOver.OnDisconnect()
+	defer connect().OnDisconnect()
+	assertDistribution([2]int32{1, 2})
+}
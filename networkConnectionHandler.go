@@ -2,14 +2,17 @@ package sshproxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/containerssh/log"
 	"github.com/containerssh/metrics"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 
 	"github.com/containerssh/sshserver"
 )
@@ -23,21 +26,71 @@ type networkConnectionHandler struct {
 	logger                log.Logger
 	backendRequestsMetric metrics.SimpleCounter
 	backendFailuresMetric metrics.SimpleCounter
+	backendPool           *backendPool
+	backendAddress        string
+	healthCheckers        map[string]*healthChecker
+	circuitBreakers       map[string]*circuitBreaker
 	tcpConn               net.Conn
 	disconnected          bool
-	privateKey            ssh.Signer
+	privateKeys           []ssh.Signer
+	certificateAuthority  *certificateAuthority
+	hostKeyVerifier       *hostKeyVerifier
+	authenticatedConn     *sshConnectionHandler
+	agentKeyring          agent.Agent
+	router                Router
+	dialer                *backendDialer
 	done                  bool
 }
 
-func (s *networkConnectionHandler) OnAuthPassword(_ string, _ []byte) (
+func (s *networkConnectionHandler) OnAuthPassword(username string, password []byte) (
 	_ sshserver.AuthResponse,
 	_ error,
 ) {
-	return sshserver.AuthResponseUnavailable, fmt.Errorf(
-		"ssh proxy does not support authentication",
+	if !s.config.AuthenticationPassThrough {
+		return sshserver.AuthResponseUnavailable, fmt.Errorf(
+			"ssh proxy does not support authentication",
+		)
+	}
+	attempted := false
+	return s.authenticateBackend(
+		username,
+		ssh.PasswordCallback(func() (secret string, err error) {
+			attempted = true
+			return string(password), nil
+		}),
+		&attempted,
 	)
 }
 
+// authenticateBackend connects the backend with the credentials the client provided. If the connection succeeds it is
+// stored and handed out in OnHandshakeSuccess instead of connecting a second time. The attempted flag must be set by
+// authMethod once it passed the credentials to the backend so failed logins can be told apart from backend errors.
+func (s *networkConnectionHandler) authenticateBackend(
+	username string,
+	authMethod ssh.AuthMethod,
+	attempted *bool,
+) (sshserver.AuthResponse, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.disconnected {
+		return sshserver.AuthResponseUnavailable, log.NewMessage(
+			EDisconnected,
+			"could not connect to backend because the user already disconnected",
+		)
+	}
+	connection, err := s.connectBackend(username, []ssh.AuthMethod{authMethod})
+	if err != nil {
+		// Only a backend rejecting the credentials is a failed login, a dropped connection is a backend error.
+		if !*attempted || getErrorCode(err) != EBackendAuthFailed {
+			return sshserver.AuthResponseUnavailable, err
+		}
+		s.logger.Debug(err)
+		return sshserver.AuthResponseFailure, err
+	}
+	s.authenticatedConn = connection
+	return sshserver.AuthResponseSuccess, nil
+}
+
 func (s *networkConnectionHandler) OnAuthPubKey(_ string, _ string) (
 	response sshserver.AuthResponse,
 	reason error,
@@ -48,17 +101,62 @@ func (s *networkConnectionHandler) OnAuthPubKey(_ string, _ string) (
 }
 
 func (s *networkConnectionHandler) OnAuthKeyboardInteractive(
-	_ string,
-	_ func(
-		_ string,
-		_ sshserver.KeyboardInteractiveQuestions,
+	username string,
+	challenge func(
+		instruction string,
+		questions sshserver.KeyboardInteractiveQuestions,
 	) (answers sshserver.KeyboardInteractiveAnswers, err error),
 ) (response sshserver.AuthResponse, reason error) {
-	return sshserver.AuthResponseUnavailable, fmt.Errorf(
-		"ssh proxy does not support authentication",
+	if !s.config.AuthenticationPassThrough {
+		return sshserver.AuthResponseUnavailable, fmt.Errorf(
+			"ssh proxy does not support authentication",
+		)
+	}
+	attempted := false
+	return s.authenticateBackend(
+		username,
+		ssh.KeyboardInteractive(func(_ string, instruction string, questions []string, echos []bool) ([]string, error) {
+			attempted = true
+			return s.relayKeyboardInteractiveChallenge(challenge, instruction, questions, echos)
+		}),
+		&attempted,
 	)
 }
 
+// relayKeyboardInteractiveChallenge passes a keyboard-interactive challenge from the backend to the client and returns
+// the answers in the order of the questions.
+func (s *networkConnectionHandler) relayKeyboardInteractiveChallenge(
+	challenge func(
+		instruction string,
+		questions sshserver.KeyboardInteractiveQuestions,
+	) (answers sshserver.KeyboardInteractiveAnswers, err error),
+	instruction string,
+	questions []string,
+	echos []bool,
+) ([]string, error) {
+	challengeQuestions := sshserver.KeyboardInteractiveQuestions{}
+	for i, question := range questions {
+		challengeQuestions.Add(sshserver.KeyboardInteractiveQuestion{
+			ID:           strconv.Itoa(i),
+			Question:     question,
+			EchoResponse: echos[i],
+		})
+	}
+	answers, err := challenge(instruction, challengeQuestions)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]string, len(challengeQuestions))
+	for i, question := range challengeQuestions {
+		answer, err := answers.Get(question)
+		if err != nil {
+			return nil, fmt.Errorf("no answer to keyboard-interactive question %d (%w)", i, err)
+		}
+		result[i] = answer
+	}
+	return result, nil
+}
+
 func (s *networkConnectionHandler) OnHandshakeFailed(_ error) {}
 
 func (s *networkConnectionHandler) OnHandshakeSuccess(username string) (
@@ -73,7 +171,28 @@ func (s *networkConnectionHandler) OnHandshakeSuccess(username string) (
 			"could not connect to backend because the user already disconnected",
 		)
 	}
-	sshConn, newChannels, requests, cli, err := s.createBackendSSHConnection(username)
+	if s.authenticatedConn != nil {
+		connection := s.authenticatedConn
+		s.authenticatedConn = nil
+		return connection, nil
+	}
+	sshConnection, err := s.connectBackend(username, nil)
+	if err != nil {
+		return nil, err
+	}
+	return sshConnection, nil
+}
+
+func (s *networkConnectionHandler) connectBackend(username string, authMethods []ssh.AuthMethod) (
+	*sshConnectionHandler,
+	error,
+) {
+	if s.router != nil {
+		if err := s.route(username); err != nil {
+			return nil, err
+		}
+	}
+	sshConn, newChannels, requests, cli, err := s.createBackendSSHConnection(username, authMethods)
 	if err != nil {
 		return nil, err
 	}
@@ -88,7 +207,33 @@ func (s *networkConnectionHandler) OnHandshakeSuccess(username string) (
 	}, nil
 }
 
-func (s *networkConnectionHandler) createBackendSSHConnection(username string) (
+// route asks the router for the backend configuration of the connection and configures the handler with it.
+func (s *networkConnectionHandler) route(username string) error {
+	config, err := s.router.Route(username, s.client, s.connectionID)
+	if err == nil {
+		config.Router = nil
+		config.RouterWebhook.URL = ""
+		err = config.Validate()
+	}
+	if err == nil {
+		err = s.configure(config)
+	}
+	if err != nil {
+		err := log.WrapUser(
+			err,
+			ERoutingFailed,
+			"SSH service is currently unavailable.",
+			"Failed to route the connection of user %s to a backend.",
+			username,
+		)
+		s.logger.Error(err)
+		return err
+	}
+	s.router = nil
+	return nil
+}
+
+func (s *networkConnectionHandler) createBackendSSHConnection(username string, authMethods []ssh.AuthMethod) (
 	ssh.Conn,
 	<-chan ssh.NewChannel,
 	<-chan *ssh.Request,
@@ -96,45 +241,256 @@ func (s *networkConnectionHandler) createBackendSSHConnection(username string) (
 	error,
 ) {
 	s.backendRequestsMetric.Increment()
-	target := fmt.Sprintf("%s:%d", s.config.Server, s.config.Port)
-	tcpConn, err := s.createBackendTCPConnection(username, target)
+	primary := s.backendPool.acquire(username, s.isBackendAvailable)
+	targets := append([]string{primary}, s.config.fallbackAddresses(primary)...)
+	ctx, cancelFunc := context.WithTimeout(context.Background(), s.config.Timeout)
+	defer cancelFunc()
+	var lastError error
+loop:
+	for attempt := 1; ; attempt++ {
+		retry := false
+		for _, target := range targets {
+			if err := s.checkBackendAvailable(target); err != nil {
+				s.logger.Debug(err)
+				if lastError == nil {
+					lastError = err
+				}
+				continue
+			}
+			sshConn, newChannels, requests, cli, err := s.createBackendSSHConnectionTo(
+				ctx,
+				username,
+				target,
+				authMethods,
+			)
+			if err == nil {
+				if target != primary {
+					s.backendPool.move(primary, target)
+				}
+				s.backendAddress = target
+				return sshConn, newChannels, requests, cli, nil
+			}
+			lastError = err
+			switch getErrorCode(err) {
+			case EBackendConnectionFailed, EJumpHostConnectionFailed, EUpstreamProxyFailed:
+				retry = retry || s.config.Retry.retryOn(RetryOnConnectionFailure)
+			case EBackendHandshakeFailed:
+				// The credentials of the user must only be sent to one backend, once.
+				if authMethods != nil {
+					break loop
+				}
+				retry = retry || s.config.Retry.retryOn(RetryOnHandshakeFailure)
+			default:
+				break loop
+			}
+			s.logger.Debug(err)
+			if ctx.Err() != nil {
+				break loop
+			}
+		}
+		if !retry || (s.config.Retry.MaxAttempts > 0 && attempt >= s.config.Retry.MaxAttempts) {
+			break
+		}
+		delay := s.config.Retry.delay(attempt)
+		s.logger.Debug(log.NewMessage(
+			EBackendConnectionFailed,
+			"connection to all SSH backends failed, retrying in %s",
+			delay,
+		))
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-time.After(delay):
+		}
+	}
+	s.backendPool.release(primary)
+	switch getErrorCode(lastError) {
+	case EBackendUnhealthy,
+		EBackendCircuitOpen,
+		EJumpHostConnectionFailed,
+		EJumpHostHandshakeFailed,
+		EProxyCommandFailed,
+		EUpstreamProxyFailed:
+		s.logger.Error(lastError)
+	case EBackendConnectionFailed:
+		lastError = log.WrapUser(
+			lastError,
+			EBackendConnectionFailed,
+			"service currently unavailable",
+			"connection to SSH backend failed, giving up",
+		)
+		s.logger.Error(lastError)
+	}
+	return nil, nil, nil, nil, lastError
+}
+
+// isBackendAvailable returns false if the health check marked the backend as unhealthy or its circuit breaker is open.
+func (s *networkConnectionHandler) isBackendAvailable(address string) bool {
+	if checker, ok := s.healthCheckers[address]; ok && !checker.isHealthy() {
+		return false
+	}
+	if breaker, ok := s.circuitBreakers[address]; ok && breaker.isOpen() {
+		return false
+	}
+	return true
+}
+
+// checkBackendAvailable returns an error if the backend should not be connected. If the circuit breaker lets the
+// connection attempt through, the attempt must be recorded with recordConnectionAttempt or cancelConnectionAttempt.
+func (s *networkConnectionHandler) checkBackendAvailable(address string) error {
+	if checker, ok := s.healthCheckers[address]; ok && !checker.isHealthy() {
+		return log.UserMessage(
+			EBackendUnhealthy,
+			"SSH service is currently unavailable.",
+			"Not connecting backend %s because it failed the health check.",
+			address,
+		).Label("backend", address)
+	}
+	if breaker, ok := s.circuitBreakers[address]; ok && !breaker.allow() {
+		return log.UserMessage(
+			EBackendCircuitOpen,
+			"SSH service is currently unavailable.",
+			"Not connecting backend %s because its circuit breaker is open.",
+			address,
+		).Label("backend", address)
+	}
+	return nil
+}
+
+// recordConnectionAttempt passes the result of a connection attempt to the circuit breaker of the backend.
+func (s *networkConnectionHandler) recordConnectionAttempt(address string, err error) {
+	breaker, ok := s.circuitBreakers[address]
+	if !ok {
+		return
+	}
+	if err == nil {
+		breaker.success()
+		return
+	}
+	if breaker.failure() {
+		s.logger.Warning(log.Wrap(
+			err,
+			EBackendCircuitOpen,
+			"Opening the circuit breaker for backend %s after repeated connection failures.",
+			address,
+		).Label("backend", address))
+	}
+}
+
+// cancelConnectionAttempt tells the circuit breaker of the backend that a connection attempt failed for a reason that
+// says nothing about the backend, such as a local configuration error.
+func (s *networkConnectionHandler) cancelConnectionAttempt(address string) {
+	if breaker, ok := s.circuitBreakers[address]; ok {
+		breaker.cancel()
+	}
+}
+
+// createBackendSSHConnectionTo makes a single attempt to connect the backend at the target address.
+func (s *networkConnectionHandler) createBackendSSHConnectionTo(
+	ctx context.Context,
+	username string,
+	target string,
+	authMethods []ssh.AuthMethod,
+) (
+	ssh.Conn,
+	<-chan ssh.NewChannel,
+	<-chan *ssh.Request,
+	*ssh.Client,
+	error,
+) {
+	tcpConn, err := s.createBackendTCPConnection(ctx, username, target)
 	if err != nil {
+		s.recordConnectionAttempt(target, err)
 		return nil, nil, nil, nil, err
 	}
 	s.tcpConn = tcpConn
 
-	sshClientConfig := s.createClientConfig(username)
+	sshClientConfig, err := s.createClientConfig(username, authMethods)
+	if err != nil {
+		s.cancelConnectionAttempt(target)
+		_ = s.tcpConn.Close()
+		s.tcpConn = nil
+		return nil, nil, nil, nil, err
+	}
 
-	sshConn, newChannels, requests, err := ssh.NewClientConn(s.tcpConn, target, sshClientConfig)
+	sshConn, newChannels, requests, stage, err := sshHandshake(
+		ctx,
+		s.tcpConn,
+		target,
+		sshClientConfig,
+		s.hostKeyVerifier,
+	)
 	if err != nil {
-		s.backendFailuresMetric.Increment(metrics.Label("failure", "handshake"))
-		return nil, nil, nil, nil, log.WrapUser(
+		_ = s.tcpConn.Close()
+		s.tcpConn = nil
+		if stage == handshakeStageHostKey {
+			s.recordConnectionAttempt(target, err)
+			s.backendFailuresMetric.Increment(metrics.Label("failure", "handshake"), metrics.Label("backend", target))
+			return nil, nil, nil, nil, err
+		}
+		if stage == handshakeStageAuthentication {
+			// The backend works, it only rejected the credentials.
+			s.recordConnectionAttempt(target, nil)
+			s.backendFailuresMetric.Increment(
+				metrics.Label("failure", "authentication"),
+				metrics.Label("backend", target),
+			)
+			return nil, nil, nil, nil, log.WrapUser(
+				err,
+				EBackendAuthFailed,
+				"Authentication failed.",
+				"The backend %s rejected the credentials.",
+				target,
+			).Label("backend", target)
+		}
+		err = log.WrapUser(
 			err,
 			EBackendHandshakeFailed,
 			"SSH service is currently unavailable.",
-			"Failed to authenticate with the backend.",
+			"The SSH handshake with the backend failed.",
 		).Label("backend", target)
+		s.recordConnectionAttempt(target, err)
+		s.backendFailuresMetric.Increment(metrics.Label("failure", "handshake"), metrics.Label("backend", target))
+		return nil, nil, nil, nil, err
 	}
+	s.recordConnectionAttempt(target, nil)
 
-	cli := ssh.NewClient(sshConn, newChannels, requests)
+	clientRequests := requests
+	if s.config.UpdateHostKeys {
+		filteredRequests := make(chan *ssh.Request)
+		go s.handleBackendGlobalRequests(sshConn, target, requests, filteredRequests)
+		clientRequests = filteredRequests
+	}
+	cli := ssh.NewClient(sshConn, newChannels, clientRequests)
+	if s.agentKeyring != nil {
+		if err := agent.ForwardToAgent(cli, s.agentKeyring); err != nil {
+			err := log.Wrap(err, EAgentForwardingFailed, "Failed to set up the agent for the backend connection.")
+			s.logger.Error(err)
+			_ = sshConn.Close()
+			s.tcpConn = nil
+			return nil, nil, nil, nil, err
+		}
+	}
 	return sshConn, newChannels, requests, cli, nil
 }
 
-func (s *networkConnectionHandler) createClientConfig(username string) *ssh.ClientConfig {
+// createClientConfig creates the configuration for the backend connection. If authMethods is nil the credentials from
+// the configuration are used.
+func (s *networkConnectionHandler) createClientConfig(username string, authMethods []ssh.AuthMethod) (
+	*ssh.ClientConfig,
+	error,
+) {
+	principal := username
 	if !s.config.UsernamePassThrough {
 		username = s.config.Username
 	}
 
-	authMethods := []ssh.AuthMethod{
-		ssh.Password(s.config.Password),
-	}
-
-	if s.privateKey != nil {
-		authMethods = append(
-			authMethods, ssh.PublicKeys(
-				s.privateKey,
-			),
-		)
+	if authMethods == nil {
+		var err error
+		authMethods, err = s.createAuthMethods(principal)
+		if err != nil {
+			return nil, err
+		}
 	}
 	sshClientConfig := &ssh.ClientConfig{
 		Config: ssh.Config{
@@ -142,67 +498,112 @@ func (s *networkConnectionHandler) createClientConfig(username string) *ssh.Clie
 			Ciphers:      s.config.Ciphers.StringList(),
 			MACs:         s.config.MACs.StringList(),
 		},
-		User: username,
-		Auth: authMethods,
-		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-			fingerprint := ssh.FingerprintSHA256(key)
-			for _, fp := range s.config.AllowedHostKeyFingerprints {
-				if fingerprint == fp {
-					return nil
-				}
-			}
-			err := log.UserMessage(
-				EInvalidFingerprint,
-				"SSH service currently unavailable",
-				"invalid host key fingerprint: %s",
-				fingerprint,
-			).Label("fingerprint", fingerprint)
-			s.logger.Error(err)
-			return err
-		},
+		User:              username,
+		Auth:              authMethods,
 		ClientVersion:     s.config.ClientVersion.String(),
 		HostKeyAlgorithms: s.config.HostKeyAlgorithms.StringList(),
 		Timeout:           s.config.Timeout,
 	}
-	return sshClientConfig
+	return sshClientConfig, nil
 }
 
-func (s *networkConnectionHandler) createBackendTCPConnection(
+// createAuthMethods creates the authentication methods from the configuration in the configured order.
+func (s *networkConnectionHandler) createAuthMethods(principal string) ([]ssh.AuthMethod, error) {
+	var authMethods []ssh.AuthMethod
+	for _, method := range s.config.AuthMethods {
+		switch method {
+		case AuthMethodPassword:
+			if s.config.Password != "" {
+				authMethods = append(authMethods, ssh.Password(s.config.Password))
+			}
+		case AuthMethodPublicKey:
+			signers, err := s.createSigners(principal)
+			if err != nil {
+				return nil, err
+			}
+			if len(signers) > 0 {
+				authMethods = append(authMethods, ssh.PublicKeys(signers...))
+			}
+		case AuthMethodKeyboardInteractive:
+			if len(s.config.KeyboardInteractiveAnswers) > 0 {
+				authMethods = append(authMethods, ssh.KeyboardInteractive(s.answerKeyboardInteractive))
+			}
+		}
+	}
+	return authMethods, nil
+}
+
+func (s *networkConnectionHandler) createSigners(principal string) ([]ssh.Signer, error) {
+	var signers []ssh.Signer
+	if s.certificateAuthority != nil {
+		// Through an upstream proxy the backend sees the address of the proxy, not our local address.
+		sourceAddress := s.tcpConn.LocalAddr()
+		if s.config.UpstreamProxy != "" {
+			sourceAddress = nil
+		}
+		certSigner, err := s.certificateAuthority.issue(
+			principal,
+			fmt.Sprintf("%s-%s", principal, s.connectionID),
+			sourceAddress,
+		)
+		if err != nil {
+			err := log.Wrap(err, ECertificateIssueFailed, "Failed to issue a certificate for the backend connection.")
+			s.logger.Error(err)
+			return nil, err
+		}
+		signers = append(signers, certSigner)
+	}
+	return append(signers, s.privateKeys...), nil
+}
+
+func (s *networkConnectionHandler) answerKeyboardInteractive(
 	_ string,
+	_ string,
+	questions []string,
+	_ []bool,
+) ([]string, error) {
+	answers := make([]string, len(questions))
+	for i, question := range questions {
+		answer, ok := s.config.KeyboardInteractiveAnswers[question]
+		if !ok {
+			return nil, fmt.Errorf("no answer configured for keyboard-interactive question: %s", question)
+		}
+		answers[i] = answer
+	}
+	return answers, nil
+}
+
+func (s *networkConnectionHandler) createBackendTCPConnection(
+	ctx context.Context,
+	username string,
 	target string,
 ) (net.Conn, error) {
 	s.logger.Debug(log.NewMessage(MConnecting, "Connecting to backend server %s", target))
-	ctx, cancelFunc := context.WithTimeout(context.Background(), s.config.Timeout)
-	defer cancelFunc()
-	var networkConnection net.Conn
-	var lastError error
-loop:
-	for {
-		networkConnection, lastError = net.Dial("tcp", target)
-		if lastError == nil {
-			return networkConnection, nil
+	networkConnection, err := s.dialer.dial(ctx, target, username)
+	if err != nil {
+		if getErrorCode(err) != "" {
+			s.backendFailuresMetric.Increment(metrics.Label("failure", "transport"), metrics.Label("backend", target))
+			return nil, err
 		}
-		s.backendFailuresMetric.Increment(metrics.Label("failure", "tcp"))
-		s.logger.Debug(log.WrapUser(
-			lastError,
+		s.backendFailuresMetric.Increment(metrics.Label("failure", "tcp"), metrics.Label("backend", target))
+		return nil, log.WrapUser(
+			err,
 			EBackendConnectionFailed,
 			"service currently unavailable",
-			"connection to SSH backend failed, retrying in 10 seconds",
-		))
-		select {
-		case <-ctx.Done():
-			break loop
-		case <-time.After(10 * time.Second):
-		}
+			"connection to SSH backend %s failed",
+			target,
+		).Label("backend", target)
 	}
-	err := log.WrapUser(
-		lastError,
-		EBackendConnectionFailed,
-		"service currently unavailable",
-		"connection to SSH backend failed, giving up",
-	)
-	s.logger.Error(err)
-	return nil, err
+	return networkConnection, nil
+}
+
+// getErrorCode returns the code of a log message, or an empty string if the error is not a log message.
+func getErrorCode(err error) string {
+	var message log.Message
+	if errors.As(err, &message) {
+		return message.Code()
+	}
+	return ""
 }
 
 func (s *networkConnectionHandler) OnDisconnect() {
@@ -223,6 +624,18 @@ func (s *networkConnectionHandler) OnDisconnect() {
 	} else {
 		s.logger.Debug(log.NewMessage(MBackendDisconnected, "Backend connection already disconnected."))
 	}
+	if s.backendAddress != "" {
+		s.backendPool.release(s.backendAddress)
+		s.backendAddress = ""
+	}
+	releaseHealthCheckers(s.healthCheckers)
+	s.healthCheckers = nil
+	releaseCircuitBreakers(s.circuitBreakers)
+	s.circuitBreakers = nil
+	if s.backendPool != nil {
+		releaseBackendPool(s.backendPool)
+		s.backendPool = nil
+	}
 }
 
 func (s *networkConnectionHandler) OnShutdown(_ context.Context) {}
@@ -0,0 +1,185 @@
+package sshproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+	"unicode"
+
+	"github.com/containerssh/log"
+)
+
+// proxyCommandData is the data available in the ProxyCommand templates.
+type proxyCommandData struct {
+	// Username is the username the client authenticated with. It is empty for health checks.
+	Username string
+	// ConnectionID is the unique identifier of the client connection. It is empty for health checks.
+	ConnectionID string
+	// RemoteAddress is the IP address of the client. It is empty for health checks.
+	RemoteAddress string
+	// Server is the hostname or IP address of the backend, or the path of its Unix socket.
+	Server string
+	// Port is the port of the backend. It is empty for Unix sockets.
+	Port string
+}
+
+// validate rejects values that could be mistaken for an option of the command or that contain control characters.
+// The username is chosen by the client, so it must not be able to change the meaning of the command.
+func (d proxyCommandData) validate() error {
+	for name, value := range map[string]string{
+		"username":       d.Username,
+		"connection ID":  d.ConnectionID,
+		"remote address": d.RemoteAddress,
+		"server":         d.Server,
+		"port":           d.Port,
+	} {
+		if strings.HasPrefix(value, "-") {
+			return fmt.Errorf("the %s %q starts with a dash", name, value)
+		}
+		if strings.IndexFunc(value, unicode.IsControl) >= 0 {
+			return fmt.Errorf("the %s %q contains control characters", name, value)
+		}
+	}
+	return nil
+}
+
+// proxyCommand starts the configured command to connect a backend.
+type proxyCommand struct {
+	templates []*template.Template
+	logger    log.Logger
+}
+
+func newProxyCommand(command []string, logger log.Logger) (*proxyCommand, error) {
+	p := &proxyCommand{
+		logger: logger,
+	}
+	for i, arg := range command {
+		tpl, err := template.New(fmt.Sprintf("proxyCommand%d", i)).Option("missingkey=error").Parse(arg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse proxy command argument %d (%w)", i, err)
+		}
+		p.templates = append(p.templates, tpl)
+	}
+	return p, nil
+}
+
+// start runs the command and returns a connection speaking to its standard input and output.
+func (p *proxyCommand) start(data proxyCommandData, target string) (net.Conn, error) {
+	if err := data.validate(); err != nil {
+		return nil, err
+	}
+	args := make([]string, len(p.templates))
+	for i, tpl := range p.templates {
+		buffer := &bytes.Buffer{}
+		if err := tpl.Execute(buffer, data); err != nil {
+			return nil, fmt.Errorf("failed to render proxy command argument %d (%w)", i, err)
+		}
+		args[i] = buffer.String()
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stderr = &proxyCommandStderr{
+		logger: p.logger.WithLabel("proxyCommand", args[0]),
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &proxyCommandConn{
+		cmd:        cmd,
+		stdin:      stdin,
+		stdout:     stdout,
+		lock:       &sync.Mutex{},
+		localAddr:  proxyCommandAddr(args[0]),
+		remoteAddr: proxyCommandAddr(target),
+	}, nil
+}
+
+// proxyCommandStderr logs the error output of a proxy command.
+type proxyCommandStderr struct {
+	logger log.Logger
+}
+
+func (p *proxyCommandStderr) Write(b []byte) (int, error) {
+	p.logger.Debug(log.NewMessage(MProxyCommandOutput, "%s", strings.TrimRight(string(b), "\r\n")))
+	return len(b), nil
+}
+
+// proxyCommandAddr is the address of a connection through a proxy command. The remote address is the address of the
+// backend in the host:port format so the host key verification can match it.
+type proxyCommandAddr string
+
+func (p proxyCommandAddr) Network() string {
+	return "proxycommand"
+}
+
+func (p proxyCommandAddr) String() string {
+	return string(p)
+}
+
+// proxyCommandConn is a connection to the standard input and output of a proxy command. Closing the connection stops
+// the command.
+type proxyCommandConn struct {
+	cmd        *exec.Cmd
+	stdin      io.WriteCloser
+	stdout     io.ReadCloser
+	lock       *sync.Mutex
+	closed     bool
+	localAddr  net.Addr
+	remoteAddr net.Addr
+}
+
+func (p *proxyCommandConn) Read(b []byte) (int, error) {
+	return p.stdout.Read(b)
+}
+
+func (p *proxyCommandConn) Write(b []byte) (int, error) {
+	return p.stdin.Write(b)
+}
+
+func (p *proxyCommandConn) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	_ = p.stdin.Close()
+	_ = p.cmd.Process.Kill()
+	// Kill fails if the command already exited, Wait still has to be called to release its resources.
+	_ = p.cmd.Wait()
+	return nil
+}
+
+func (p *proxyCommandConn) LocalAddr() net.Addr {
+	return p.localAddr
+}
+
+func (p *proxyCommandConn) RemoteAddr() net.Addr {
+	return p.remoteAddr
+}
+
+func (p *proxyCommandConn) SetDeadline(_ time.Time) error {
+	return fmt.Errorf("deadlines are not supported on proxy command connections")
+}
+
+func (p *proxyCommandConn) SetReadDeadline(_ time.Time) error {
+	return fmt.Errorf("deadlines are not supported on proxy command connections")
+}
+
+func (p *proxyCommandConn) SetWriteDeadline(_ time.Time) error {
+	return fmt.Errorf("deadlines are not supported on proxy command connections")
+}
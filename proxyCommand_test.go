@@ -0,0 +1,64 @@
+package sshproxy_test
+
+import (
+	"flag"
+	"io"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/containerssh/sshproxy"
+)
+
+// TestProxyCommandHelper is the proxy command started by TestProxyCommand. It connects the host and port passed after
+// "--" and copies its standard input and output to the connection. It does nothing when run as a test.
+func TestProxyCommandHelper(t *testing.T) {
+	args := flag.Args()
+	if len(args) != 3 {
+		return
+	}
+	if args[0] != "test" {
+		os.Exit(1)
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(args[1], args[2]))
+	if err != nil {
+		os.Exit(1)
+	}
+	go func() {
+		_, _ = io.Copy(conn, os.Stdin)
+		_ = conn.Close()
+	}()
+	_, _ = io.Copy(os.Stdout, conn)
+	os.Exit(0)
+}
+
+func TestProxyCommand(t *testing.T) {
+	backend := startHostKeyTestBackend(t)
+	config := backend.config()
+	config.ProxyCommand = []string{
+		os.Args[0],
+		"-test.run=^TestProxyCommandHelper$",
+		"--",
+		"{{ .Username }}",
+		"{{ .Server }}",
+		"{{ .Port }}",
+	}
+	config.Retry.MaxAttempts = 1
+
+	if err := connectHostKeyTestBackend(t, config); err != nil {
+		t.Fatalf("failed to connect backend through proxy command (%v)", err)
+	}
+
+	for _, username := range []string{"-test.run=^$", "test\nother"} {
+		proxy, err := newTestProxy(t, config)
+		if err != nil {
+			t.Fatalf("failed to create proxy (%v)", err)
+		}
+		_, err = proxy.OnHandshakeSuccess(username)
+		proxy.OnDisconnect()
+		assertErrorCode(t, err, sshproxy.EProxyCommandFailed)
+	}
+
+	config.ProxyCommand[0] = "/nonexistent"
+	assertErrorCode(t, connectHostKeyTestBackend(t, config), sshproxy.EProxyCommandFailed)
+}
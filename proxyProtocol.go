@@ -0,0 +1,112 @@
+package sshproxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// proxyProtocolV2Signature starts every PROXY protocol v2 header.
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolHeader holds the information sent to the backend in the PROXY protocol header.
+type proxyProtocolHeader struct {
+	// source is the client address. It is nil for connections not belonging to a client, such as health checks.
+	source *net.TCPAddr
+	// destination is the backend address the connection is made to.
+	destination net.Addr
+	// tlvs are the type-length-value fields of the v2 header.
+	tlvs map[byte]string
+}
+
+// marshal encodes the header in the requested version.
+func (p proxyProtocolHeader) marshal(version ProxyProtocolVersion) ([]byte, error) {
+	switch version {
+	case ProxyProtocolV1:
+		return p.marshalV1(), nil
+	case ProxyProtocolV2:
+		return p.marshalV2()
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol version: %s", version)
+	}
+}
+
+// addresses returns the source and destination IPs in the same family along with the family. The destination is the
+// unspecified address if it is not a TCP address of the source's family, for example a Unix socket.
+func (p proxyProtocolHeader) addresses() (sourceIP net.IP, destinationIP net.IP, destinationPort int, ipv4 bool) {
+	sourceIP = p.source.IP.To4()
+	ipv4 = sourceIP != nil
+	if !ipv4 {
+		sourceIP = p.source.IP.To16()
+	}
+	destinationIP = net.IPv4zero.To4()
+	if !ipv4 {
+		destinationIP = net.IPv6unspecified
+	}
+	if tcpAddr, ok := p.destination.(*net.TCPAddr); ok {
+		if ip4 := tcpAddr.IP.To4(); ipv4 && ip4 != nil {
+			destinationIP = ip4
+			destinationPort = tcpAddr.Port
+		} else if !ipv4 && ip4 == nil && tcpAddr.IP.To16() != nil {
+			destinationIP = tcpAddr.IP.To16()
+			destinationPort = tcpAddr.Port
+		}
+	}
+	return sourceIP, destinationIP, destinationPort, ipv4
+}
+
+func (p proxyProtocolHeader) marshalV1() []byte {
+	if p.source == nil || p.source.IP.To16() == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	sourceIP, destinationIP, destinationPort, ipv4 := p.addresses()
+	family := "TCP6"
+	if ipv4 {
+		family = "TCP4"
+	}
+	return []byte(fmt.Sprintf(
+		"PROXY %s %s %s %d %d\r\n",
+		family,
+		sourceIP,
+		destinationIP,
+		p.source.Port,
+		destinationPort,
+	))
+}
+
+func (p proxyProtocolHeader) marshalV2() ([]byte, error) {
+	header := append([]byte{}, proxyProtocolV2Signature...)
+	if p.source == nil || p.source.IP.To16() == nil {
+		// LOCAL command, the backend uses the real connection endpoints.
+		return append(header, 0x20, 0x00, 0x00, 0x00), nil
+	}
+	sourceIP, destinationIP, destinationPort, ipv4 := p.addresses()
+	family := byte(0x21)
+	if ipv4 {
+		family = 0x11
+	}
+	var body []byte
+	body = append(body, sourceIP...)
+	body = append(body, destinationIP...)
+	body = append(body, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(body[len(body)-4:], uint16(p.source.Port))
+	binary.BigEndian.PutUint16(body[len(body)-2:], uint16(destinationPort))
+	for _, tlvType := range []byte{ProxyProtocolTLVConnectionID, ProxyProtocolTLVUsername} {
+		value, ok := p.tlvs[tlvType]
+		if !ok || value == "" {
+			continue
+		}
+		if len(value) > 0xffff {
+			return nil, fmt.Errorf("PROXY protocol TLV 0x%x too long", tlvType)
+		}
+		body = append(body, tlvType, 0, 0)
+		binary.BigEndian.PutUint16(body[len(body)-2:], uint16(len(value)))
+		body = append(body, value...)
+	}
+	if len(body) > 0xffff {
+		return nil, fmt.Errorf("PROXY protocol header too long")
+	}
+	header = append(header, 0x21, family, 0, 0)
+	binary.BigEndian.PutUint16(header[len(header)-2:], uint16(len(body)))
+	return append(header, body...), nil
+}
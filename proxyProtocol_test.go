@@ -0,0 +1,155 @@
+package sshproxy_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/containerssh/sshproxy"
+)
+
+// proxyProtocolTestHeader is the PROXY protocol header received by the test listener.
+type proxyProtocolTestHeader struct {
+	v1     string
+	source *net.TCPAddr
+	tlvs   map[byte]string
+}
+
+// startProxyProtocolTestListener accepts a single connection, reads the PROXY protocol header and forwards the rest of
+// the connection to the backend.
+func startProxyProtocolTestListener(
+	t *testing.T,
+	backend *testBackend,
+	version sshproxy.ProxyProtocolVersion,
+) (*net.TCPAddr, <-chan proxyProtocolTestHeader) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen (%v)", err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	headers := make(chan proxyProtocolTestHeader, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		reader := bufio.NewReader(conn)
+		var header proxyProtocolTestHeader
+		if version == sshproxy.ProxyProtocolV1 {
+			header.v1, err = reader.ReadString('\n')
+		} else {
+			header, err = readProxyProtocolV2(reader)
+		}
+		if err != nil {
+			t.Errorf("failed to read PROXY protocol header (%v)", err)
+			_ = conn.Close()
+			return
+		}
+		headers <- header
+		backendConn, err := net.Dial("tcp", backend.listener.Addr().String())
+		if err != nil {
+			_ = conn.Close()
+			return
+		}
+		go func() {
+			_, _ = io.Copy(backendConn, reader)
+			_ = backendConn.Close()
+		}()
+		_, _ = io.Copy(conn, backendConn)
+		_ = conn.Close()
+	}()
+	return listener.Addr().(*net.TCPAddr), headers
+}
+
+func readProxyProtocolV2(reader io.Reader) (proxyProtocolTestHeader, error) {
+	header := proxyProtocolTestHeader{
+		tlvs: map[byte]string{},
+	}
+	prefix := make([]byte, 16)
+	if _, err := io.ReadFull(reader, prefix); err != nil {
+		return header, err
+	}
+	body := make([]byte, binary.BigEndian.Uint16(prefix[14:]))
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return header, err
+	}
+	if !bytes.Equal(prefix[:12], []byte("\r\n\r\n\x00\r\nQUIT\n")) || prefix[12] != 0x21 || prefix[13] != 0x11 {
+		return header, io.ErrUnexpectedEOF
+	}
+	header.source = &net.TCPAddr{
+		IP:   net.IP(body[0:4]),
+		Port: int(binary.BigEndian.Uint16(body[8:10])),
+	}
+	for tlvs := body[12:]; len(tlvs) >= 3; {
+		length := int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+length {
+			return header, io.ErrUnexpectedEOF
+		}
+		header.tlvs[tlvs[0]] = string(tlvs[3 : 3+length])
+		tlvs = tlvs[3+length:]
+	}
+	return header, nil
+}
+
+func TestProxyProtocol(t *testing.T) {
+	backend := startHostKeyTestBackend(t)
+
+	for name, testCase := range map[string]struct {
+		version sshproxy.ProxyProtocolVersion
+		tlvs    bool
+	}{
+		"v1": {
+			version: sshproxy.ProxyProtocolV1,
+		},
+		"v2": {
+			version: sshproxy.ProxyProtocolV2,
+		},
+		"v2-tlvs": {
+			version: sshproxy.ProxyProtocolV2,
+			tlvs:    true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			address, headers := startProxyProtocolTestListener(t, backend, testCase.version)
+			config := backend.config()
+			config.Server = address.IP.String()
+			config.Port = uint16(address.Port)
+			config.ProxyProtocol = testCase.version
+			config.ProxyProtocolTLVs = testCase.tlvs
+			config.Retry.MaxAttempts = 1
+			if err := connectHostKeyTestBackend(t, config); err != nil {
+				t.Fatalf("failed to connect backend with PROXY protocol header (%v)", err)
+			}
+			header := <-headers
+
+			if testCase.version == sshproxy.ProxyProtocolV1 {
+				expected := "PROXY TCP4 127.0.0.1 127.0.0.1 2222 " + strconv.Itoa(address.Port) + "\r\n"
+				if header.v1 != expected {
+					t.Fatalf("unexpected PROXY protocol v1 header: %q, expected: %q", header.v1, expected)
+				}
+				return
+			}
+			if header.source.String() != "127.0.0.1:2222" {
+				t.Fatalf("unexpected source address in PROXY protocol v2 header: %s", header.source)
+			}
+			if !testCase.tlvs {
+				if len(header.tlvs) != 0 {
+					t.Fatalf("unexpected TLVs in PROXY protocol v2 header: %v", header.tlvs)
+				}
+				return
+			}
+			if header.tlvs[sshproxy.ProxyProtocolTLVUsername] != "test" {
+				t.Fatalf("unexpected username TLV: %q", header.tlvs[sshproxy.ProxyProtocolTLVUsername])
+			}
+			if header.tlvs[sshproxy.ProxyProtocolTLVConnectionID] == "" {
+				t.Fatalf("missing connection ID TLV")
+			}
+		})
+	}
+}
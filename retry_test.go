@@ -0,0 +1,221 @@
+package sshproxy_test
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/containerssh/sshproxy"
+	"github.com/containerssh/sshserver"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	for name, testCase := range map[string]struct {
+		maxAttempts  int
+		retryOn      []sshproxy.RetryCondition
+		expectedCode string
+	}{
+		"success": {
+			maxAttempts: 3,
+			retryOn:     []sshproxy.RetryCondition{sshproxy.RetryOnHandshakeFailure},
+		},
+		"max-attempts": {
+			maxAttempts:  2,
+			retryOn:      []sshproxy.RetryCondition{sshproxy.RetryOnHandshakeFailure},
+			expectedCode: sshproxy.EBackendHandshakeFailed,
+		},
+		"not-retryable": {
+			maxAttempts:  3,
+			retryOn:      []sshproxy.RetryCondition{sshproxy.RetryOnConnectionFailure},
+			expectedCode: sshproxy.EBackendHandshakeFailed,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// The backend drops the first two connections during the handshake.
+			backend := startHostKeyTestBackend(t)
+			addr := startDroppingListener(t, backend, 2)
+			config := backend.config()
+			config.Port = uint16(addr.Port)
+			config.Retry.MaxAttempts = testCase.maxAttempts
+			config.Retry.InitialDelay = 10 * time.Millisecond
+			config.Retry.Multiplier = 2
+			config.Retry.Jitter = 0.5
+			config.Retry.RetryOn = testCase.retryOn
+
+			err := connectHostKeyTestBackend(t, config)
+			if testCase.expectedCode == "" {
+				if err != nil {
+					t.Fatalf("failed to connect backend (%v)", err)
+				}
+				return
+			}
+			assertErrorCode(t, err, testCase.expectedCode)
+		})
+	}
+}
+
+func TestRetryPolicyCredentials(t *testing.T) {
+	for name, testCase := range map[string]struct {
+		passThrough  bool
+		expectedCode string
+	}{
+		"configured-credentials": {},
+		"pass-through": {
+			passThrough:  true,
+			expectedCode: sshproxy.EBackendHandshakeFailed,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// The first handshake fails, the second one would succeed.
+			backend := startTestBackend(
+				t,
+				&ssh.ServerConfig{
+					PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+						if string(password) != "test" {
+							return nil, fmt.Errorf("invalid credentials")
+						}
+						return nil, nil
+					},
+				},
+				func(conn *ssh.ServerConn, channels <-chan ssh.NewChannel, requests <-chan *ssh.Request) {
+					go ssh.DiscardRequests(requests)
+					rejectChannels(channels)
+				},
+			)
+			addr := startDroppingListener(t, backend, 1)
+			config := backend.config()
+			config.Port = uint16(addr.Port)
+			config.AuthenticationPassThrough = testCase.passThrough
+			config.UsernamePassThrough = testCase.passThrough
+			config.Retry.MaxAttempts = 3
+			config.Retry.InitialDelay = 10 * time.Millisecond
+			config.Retry.RetryOn = []sshproxy.RetryCondition{sshproxy.RetryOnHandshakeFailure}
+
+			proxy, err := newTestProxy(t, config)
+			if err != nil {
+				t.Fatalf("failed to create proxy (%v)", err)
+			}
+			defer proxy.OnDisconnect()
+			if testCase.passThrough {
+				_, err = proxy.OnAuthPassword("test", []byte("test"))
+			} else {
+				_, err = proxy.OnHandshakeSuccess("test")
+			}
+			if testCase.expectedCode == "" {
+				if err != nil {
+					t.Fatalf("failed to connect backend (%v)", err)
+				}
+				return
+			}
+			assertErrorCode(t, err, testCase.expectedCode)
+		})
+	}
+}
+
+func TestRetryPolicyAuthenticationFailure(t *testing.T) {
+	var attempts int32
+	backend := startTestBackend(
+		t,
+		&ssh.ServerConfig{
+			PasswordCallback: func(_ ssh.ConnMetadata, _ []byte) (*ssh.Permissions, error) {
+				atomic.AddInt32(&attempts, 1)
+				return nil, fmt.Errorf("invalid credentials")
+			},
+		},
+		func(conn *ssh.ServerConn, channels <-chan ssh.NewChannel, requests <-chan *ssh.Request) {
+			go ssh.DiscardRequests(requests)
+			rejectChannels(channels)
+		},
+	)
+	config := backend.config()
+	config.Retry.MaxAttempts = 3
+	config.Retry.InitialDelay = 10 * time.Millisecond
+	config.Retry.RetryOn = []sshproxy.RetryCondition{sshproxy.RetryOnHandshakeFailure}
+
+	assertErrorCode(t, connectHostKeyTestBackend(t, config), sshproxy.EBackendAuthFailed)
+	if n := atomic.LoadInt32(&attempts); n != 1 {
+		t.Fatalf("the rejected credentials were tried %d times", n)
+	}
+}
+
+// startAuthDroppingTestBackend starts a backend that closes the first drops connections when it receives the password,
+// and accepts any password afterwards.
+func startAuthDroppingTestBackend(t *testing.T, drops int32) *testBackend {
+	hostKey := generateTestSigner(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen (%v)", err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	var connections int32
+	go func() {
+		for {
+			tcpConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			drop := atomic.AddInt32(&connections, 1) <= drops
+			serverConfig := &ssh.ServerConfig{
+				PasswordCallback: func(_ ssh.ConnMetadata, _ []byte) (*ssh.Permissions, error) {
+					if drop {
+						_ = tcpConn.Close()
+						return nil, fmt.Errorf("connection closed")
+					}
+					return nil, nil
+				},
+			}
+			serverConfig.AddHostKey(hostKey)
+			go func() {
+				conn, channels, requests, err := ssh.NewServerConn(tcpConn, serverConfig)
+				if err != nil {
+					_ = tcpConn.Close()
+					return
+				}
+				go ssh.DiscardRequests(requests)
+				rejectChannels(channels)
+				_ = conn.Close()
+			}()
+		}
+	}()
+	return &testBackend{
+		listener:    listener,
+		hostKey:     hostKey,
+		fingerprint: ssh.FingerprintSHA256(hostKey.PublicKey()),
+	}
+}
+
+// TestRetryPolicyConnectionClosedDuringAuthentication checks that the backend closing the connection while
+// authenticating is a handshake failure, not rejected credentials.
+func TestRetryPolicyConnectionClosedDuringAuthentication(t *testing.T) {
+	t.Run("configured-credentials", func(t *testing.T) {
+		config := startAuthDroppingTestBackend(t, 1).config()
+		config.Retry.MaxAttempts = 2
+		config.Retry.InitialDelay = 10 * time.Millisecond
+		config.Retry.RetryOn = []sshproxy.RetryCondition{sshproxy.RetryOnHandshakeFailure}
+		if err := connectHostKeyTestBackend(t, config); err != nil {
+			t.Fatalf("failed to connect backend (%v)", err)
+		}
+	})
+
+	t.Run("pass-through", func(t *testing.T) {
+		config := startAuthDroppingTestBackend(t, 1).config()
+		config.AuthenticationPassThrough = true
+		config.UsernamePassThrough = true
+		proxy, err := newTestProxy(t, config)
+		if err != nil {
+			t.Fatalf("failed to create proxy (%v)", err)
+		}
+		defer proxy.OnDisconnect()
+		response, err := proxy.OnAuthPassword("test", []byte("test"))
+		assertErrorCode(t, err, sshproxy.EBackendHandshakeFailed)
+		if response != sshserver.AuthResponseUnavailable {
+			t.Fatalf("a closed connection was reported as rejected credentials")
+		}
+	})
+}
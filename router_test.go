@@ -0,0 +1,89 @@
+package sshproxy_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/containerssh/structutils"
+
+	"github.com/containerssh/sshproxy"
+)
+
+func TestHTTPRouter(t *testing.T) {
+	backend := startHostKeyTestBackend(t)
+	requests := make(chan sshproxy.RoutingRequest, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := sshproxy.RoutingRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || r.URL.Path != "/route" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		requests <- request
+		if request.Username != "test" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(sshproxy.RoutingResponse{Config: backend.config()})
+	}))
+	defer server.Close()
+
+	config := sshproxy.Config{}
+	structutils.Defaults(&config)
+	config.RouterWebhook.URL = server.URL
+
+	if err := connectHostKeyTestBackend(t, config); err != nil {
+		t.Fatalf("failed to connect routed backend (%v)", err)
+	}
+	request := <-requests
+	if request.RemoteAddress != "127.0.0.1" || request.ConnectionID == "" {
+		t.Fatalf("unexpected routing request: %v", request)
+	}
+
+	proxy, err := newTestProxy(t, config)
+	if err != nil {
+		t.Fatalf("failed to create proxy (%v)", err)
+	}
+	defer proxy.OnDisconnect()
+	_, err = proxy.OnHandshakeSuccess("unknown")
+	assertErrorCode(t, err, sshproxy.ERoutingFailed)
+}
+
+func TestHTTPRouterRejectsLocalOptions(t *testing.T) {
+	backend := startHostKeyTestBackend(t)
+	for name, modify := range map[string]func(config *sshproxy.Config){
+		"proxy-command": func(config *sshproxy.Config) {
+			config.ProxyCommand = []string{"nc", "{{ .Server }}", "{{ .Port }}"}
+		},
+		"host-key-store-file": func(config *sshproxy.Config) {
+			config.HostKeyStoreFile = "/etc/ssh/ssh_known_hosts"
+		},
+		"private-key-file": func(config *sshproxy.Config) {
+			config.PrivateKey = "/etc/ssh/ssh_host_ed25519_key"
+		},
+		"passphrase-env": func(config *sshproxy.Config) {
+			config.PrivateKeyPassphraseEnv = "HOME"
+		},
+		"unix-socket-fallback": func(config *sshproxy.Config) {
+			config.Fallbacks = []sshproxy.Backend{{Server: "unix:///var/run/docker.sock"}}
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				config := backend.config()
+				modify(&config)
+				w.Header().Set("Content-Type", "application/json")
+				_ = json.NewEncoder(w).Encode(sshproxy.RoutingResponse{Config: config})
+			}))
+			defer server.Close()
+
+			config := sshproxy.Config{}
+			structutils.Defaults(&config)
+			config.RouterWebhook.URL = server.URL
+
+			assertErrorCode(t, connectHostKeyTestBackend(t, config), sshproxy.ERoutingFailed)
+		})
+	}
+}
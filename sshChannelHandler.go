@@ -175,6 +175,9 @@ func (s *sshChannelHandler) streamStdin() {
 	}
 }
 
+// OnUnsupportedChannelRequest receives requests such as auth-agent-req@openssh.com and x11-req. Agent and X11
+// forwarding cannot be proxied because the auth-agent@openssh.com and x11 channels the backend opens in response would
+// have to be opened towards the client, which the sshserver library does not allow.
 func (s *sshChannelHandler) OnUnsupportedChannelRequest(_ uint64, _ string, _ []byte) {}
 
 func (s *sshChannelHandler) OnFailedDecodeChannelRequest(
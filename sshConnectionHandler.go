@@ -20,9 +20,15 @@ type sshConnectionHandler struct {
 	logger         log.Logger
 }
 
+// OnUnsupportedGlobalRequest is called for global requests such as tcpip-forward. These cannot be relayed to the
+// backend because the sshserver library always replies with a failure and offers no way to open the resulting
+// forwarded-tcpip channels towards the client.
 func (s *sshConnectionHandler) OnUnsupportedGlobalRequest(_ uint64, _ string, _ []byte) {
 }
 
+// OnUnsupportedChannel is called for every non-session channel, such as direct-tcpip. These channels cannot be proxied
+// because the sshserver library rejects them once this method returns and does not hand us the client channel to
+// relay.
 func (s *sshConnectionHandler) OnUnsupportedChannel(_ uint64, _ string, _ []byte) {
 }
 
@@ -69,6 +75,10 @@ func (s *sshConnectionHandler) OnSessionChannel(
 		return nil, failureReason
 	}
 
+	if s.networkHandler.agentKeyring != nil {
+		s.requestAgentForwarding(backingChannel)
+	}
+
 	sshChannelHandlerInstance := &sshChannelHandler{
 		ssh:            s,
 		lock:           &sync.Mutex{},
@@ -85,5 +95,16 @@ func (s *sshConnectionHandler) OnSessionChannel(
 	return sshChannelHandlerInstance, nil
 }
 
+func (s *sshConnectionHandler) requestAgentForwarding(backingChannel ssh.Channel) {
+	success, err := backingChannel.SendRequest("auth-agent-req@openssh.com", true, nil)
+	if err != nil {
+		s.logger.Debug(log.Wrap(err, EAgentForwardingFailed, "Failed to request agent forwarding on the backend session."))
+		return
+	}
+	if !success {
+		s.logger.Debug(log.NewMessage(EAgentForwardingFailed, "Backend rejected the agent forwarding request."))
+	}
+}
+
 func (s *sshConnectionHandler) OnShutdown(_ context.Context) {
 }
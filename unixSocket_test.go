@@ -0,0 +1,57 @@
+package sshproxy_test
+
+import (
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnixSocketBackend(t *testing.T) {
+	// The unix socket forwards to the TCP test backend.
+	backend := startHostKeyTestBackend(t)
+	socket := filepath.Join(t.TempDir(), "sshd.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("failed to listen on unix socket (%v)", err)
+	}
+	defer func() {
+		_ = listener.Close()
+	}()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			backendConn, err := net.Dial("tcp", backend.listener.Addr().String())
+			if err != nil {
+				_ = conn.Close()
+				continue
+			}
+			go pipeConnections(conn, backendConn)
+		}
+	}()
+
+	config := backend.config()
+	config.Server = "unix://" + socket
+	config.Port = 0
+	if err := connectHostKeyTestBackend(t, config); err != nil {
+		t.Fatalf("failed to connect unix socket backend (%v)", err)
+	}
+
+	config.KnownHostsFiles = []string{filepath.Join(t.TempDir(), "known_hosts")}
+	if _, err := newTestProxy(t, config); err == nil {
+		t.Fatalf("known hosts files were accepted for a unix socket backend")
+	}
+}
+
+// pipeConnections copies data between two connections until either is closed.
+func pipeConnections(a net.Conn, b net.Conn) {
+	go func() {
+		_, _ = io.Copy(a, b)
+		_ = a.Close()
+	}()
+	_, _ = io.Copy(b, a)
+	_ = b.Close()
+}
@@ -0,0 +1,355 @@
+package sshproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/containerssh/log"
+)
+
+// upstreamProxy connects TCP addresses through a SOCKS5 or HTTP CONNECT proxy.
+type upstreamProxy struct {
+	scheme   string
+	address  string
+	user     *url.Userinfo
+	redacted string
+}
+
+// upstreamProxyTargetError is returned when the proxy works, but reports that it could not connect the target.
+type upstreamProxyTargetError struct {
+	reason string
+}
+
+func (u *upstreamProxyTargetError) Error() string {
+	return fmt.Sprintf("the upstream proxy could not connect the target: %s", u.reason)
+}
+
+func newUpstreamProxy(rawURL string) (*upstreamProxy, error) {
+	proxyURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream proxy URL (%w)", err)
+	}
+	defaultPort := ""
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		defaultPort = "1080"
+	case "http":
+		defaultPort = "80"
+	default:
+		return nil, fmt.Errorf("unsupported upstream proxy scheme: %s", proxyURL.Scheme)
+	}
+	if proxyURL.Hostname() == "" {
+		return nil, fmt.Errorf("upstream proxy host cannot be empty")
+	}
+	port := proxyURL.Port()
+	if port == "" {
+		port = defaultPort
+	}
+	redacted := *proxyURL
+	if redacted.User != nil {
+		redacted.User = url.User(redacted.User.Username())
+	}
+	return &upstreamProxy{
+		scheme:   proxyURL.Scheme,
+		address:  net.JoinHostPort(proxyURL.Hostname(), port),
+		user:     proxyURL.User,
+		redacted: redacted.String(),
+	}, nil
+}
+
+// dial connects the target through the proxy. Failures of the proxy itself are returned as log messages with the
+// EUpstreamProxyFailed code, failures to reach the target are returned as they are. The remote address of the returned
+// connection is the target, not the proxy.
+func (u *upstreamProxy) dial(ctx context.Context, target string) (net.Conn, error) {
+	if u.scheme == "socks5" {
+		// With socks5:// the hostname is resolved locally, only socks5h:// leaves it to the proxy.
+		var err error
+		if target, err = resolveTarget(ctx, target); err != nil {
+			return nil, err
+		}
+	}
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", u.address)
+	if err != nil {
+		return nil, u.wrapError(err, target)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	var proxyConn net.Conn
+	switch u.scheme {
+	case "http":
+		proxyConn, err = u.connectHTTP(conn, target)
+	default:
+		proxyConn, err = u.connectSOCKS5(conn, target)
+	}
+	if err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		_ = conn.Close()
+		var targetError *upstreamProxyTargetError
+		if errors.As(err, &targetError) {
+			return nil, err
+		}
+		return nil, u.wrapError(err, target)
+	}
+	return &upstreamProxyConn{
+		Conn:       proxyConn,
+		remoteAddr: upstreamProxyTargetAddr(target),
+	}, nil
+}
+
+// resolveTarget replaces the hostname in the host:port target with its first IP address.
+func resolveTarget(ctx context.Context, target string) (string, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", err
+	}
+	if net.ParseIP(host) != nil {
+		return target, nil
+	}
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	if len(addresses) == 0 {
+		return "", fmt.Errorf("no addresses found for %s", host)
+	}
+	return net.JoinHostPort(addresses[0].IP.String(), port), nil
+}
+
+// upstreamProxyTargetAddr returns the address of the target of a connection through the upstream proxy. It is a
+// *net.TCPAddr if the target is an IP address. A hostname resolved by the proxy is returned in the host:port format so
+// the host key verification can still match it, but it is not a *net.TCPAddr since the IP address is unknown.
+func upstreamProxyTargetAddr(target string) net.Addr {
+	host, port, err := net.SplitHostPort(target)
+	if err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			if portNumber, err := strconv.Atoi(port); err == nil {
+				return &net.TCPAddr{IP: ip, Port: portNumber}
+			}
+		}
+	}
+	return upstreamProxyHostAddr(target)
+}
+
+// upstreamProxyHostAddr is the address of a target the upstream proxy resolved by hostname.
+type upstreamProxyHostAddr string
+
+func (u upstreamProxyHostAddr) Network() string {
+	return "tcp"
+}
+
+func (u upstreamProxyHostAddr) String() string {
+	return string(u)
+}
+
+// upstreamProxyConn is a connection through the upstream proxy. Its remote address is the target instead of the
+// proxy.
+type upstreamProxyConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (u *upstreamProxyConn) RemoteAddr() net.Addr {
+	return u.remoteAddr
+}
+
+func (u *upstreamProxy) wrapError(err error, target string) error {
+	return log.WrapUser(
+		err,
+		EUpstreamProxyFailed,
+		"SSH service is currently unavailable.",
+		"Upstream proxy %s failed to connect %s.",
+		u.redacted,
+		target,
+	).Label("upstreamProxy", u.address)
+}
+
+// connectHTTP sends an HTTP CONNECT request for the target.
+func (u *upstreamProxy) connectHTTP(conn net.Conn, target string) (net.Conn, error) {
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: http.Header{},
+	}
+	if u.user != nil {
+		password, _ := u.user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(u.user.Username() + ":" + password))
+		request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := request.Write(conn); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		return nil, err
+	}
+	_ = response.Body.Close()
+	switch response.StatusCode {
+	case http.StatusOK:
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return nil, &upstreamProxyTargetError{reason: response.Status}
+	default:
+		return nil, fmt.Errorf("unexpected response from HTTP proxy: %s", response.Status)
+	}
+	// The proxy may have sent the beginning of the backend's data along with the response.
+	return &bufferedConn{
+		Conn:   conn,
+		reader: reader,
+	}, nil
+}
+
+// SOCKS5 protocol constants from RFC 1928 and RFC 1929.
+const (
+	socks5Version              = 5
+	socks5AuthNone             = 0
+	socks5AuthPassword         = 2
+	socks5AuthNoAcceptable     = 0xff
+	socks5PasswordAuthVersion  = 1
+	socks5CommandConnect       = 1
+	socks5AddressIPv4          = 1
+	socks5AddressDomain        = 3
+	socks5AddressIPv6          = 4
+	socks5ReplySucceeded       = 0
+	socks5ReplyNetUnreachable  = 3
+	socks5ReplyHostUnreachable = 4
+	socks5ReplyRefused         = 5
+	socks5ReplyTTLExpired      = 6
+)
+
+// connectSOCKS5 negotiates a SOCKS5 CONNECT to the target. A hostname in the target is resolved by the proxy.
+func (u *upstreamProxy) connectSOCKS5(conn net.Conn, target string) (net.Conn, error) {
+	host, portString, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port: %s", portString)
+	}
+
+	methods := []byte{socks5AuthNone}
+	if u.user != nil {
+		methods = []byte{socks5AuthPassword}
+	}
+	if _, err := conn.Write(append([]byte{socks5Version, byte(len(methods))}, methods...)); err != nil {
+		return nil, err
+	}
+	response := make([]byte, 2)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+	if response[0] != socks5Version {
+		return nil, fmt.Errorf("unexpected SOCKS version: %d", response[0])
+	}
+	switch response[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if err := u.authenticateSOCKS5(conn); err != nil {
+			return nil, err
+		}
+	case socks5AuthNoAcceptable:
+		return nil, fmt.Errorf("the SOCKS proxy did not accept any authentication method")
+	default:
+		return nil, fmt.Errorf("unexpected SOCKS authentication method: %d", response[1])
+	}
+
+	request := []byte{socks5Version, socks5CommandConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("hostname too long: %s", host)
+		}
+		request = append(request, socks5AddressDomain, byte(len(host)))
+		request = append(request, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		request = append(request, socks5AddressIPv4)
+		request = append(request, ip4...)
+	} else {
+		request = append(request, socks5AddressIPv6)
+		request = append(request, ip.To16()...)
+	}
+	request = append(request, 0, 0)
+	binary.BigEndian.PutUint16(request[len(request)-2:], uint16(port))
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+	switch reply[1] {
+	case socks5ReplySucceeded:
+	case socks5ReplyNetUnreachable, socks5ReplyHostUnreachable, socks5ReplyRefused, socks5ReplyTTLExpired:
+		return nil, &upstreamProxyTargetError{reason: fmt.Sprintf("SOCKS reply %d", reply[1])}
+	default:
+		return nil, fmt.Errorf("SOCKS proxy failed with reply %d", reply[1])
+	}
+	// The bound address is not needed, but has to be read before the connection carries the backend's data.
+	var addressLength int
+	switch reply[3] {
+	case socks5AddressIPv4:
+		addressLength = net.IPv4len
+	case socks5AddressIPv6:
+		addressLength = net.IPv6len
+	case socks5AddressDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return nil, err
+		}
+		addressLength = int(length[0])
+	default:
+		return nil, fmt.Errorf("unexpected SOCKS address type: %d", reply[3])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, addressLength+2)); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (u *upstreamProxy) authenticateSOCKS5(conn net.Conn) error {
+	username := u.user.Username()
+	password, _ := u.user.Password()
+	if len(username) > 255 || len(password) > 255 {
+		return fmt.Errorf("SOCKS username or password too long")
+	}
+	request := []byte{socks5PasswordAuthVersion, byte(len(username))}
+	request = append(request, username...)
+	request = append(request, byte(len(password)))
+	request = append(request, password...)
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+	response := make([]byte, 2)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return err
+	}
+	if response[1] != 0 {
+		return fmt.Errorf("SOCKS proxy authentication failed")
+	}
+	return nil
+}
+
+// bufferedConn is a connection with data already read into a buffer.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.reader.Read(p)
+}
@@ -0,0 +1,259 @@
+package sshproxy_test
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/containerssh/sshproxy"
+)
+
+// startTestUpstreamProxy starts a proxy on a random port that serves each connection with the handler.
+func startTestUpstreamProxy(t *testing.T, handler func(conn net.Conn)) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen for the upstream proxy (%v)", err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handler(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// serveTestSOCKS5 is a minimal SOCKS5 proxy for IPv4 and hostname targets accepting the username "proxy" with the
+// password "proxy".
+func serveTestSOCKS5(conn net.Conn) {
+	serveRecordingTestSOCKS5(conn, nil)
+}
+
+// serveRecordingTestSOCKS5 is serveTestSOCKS5 sending the address type of the request to addressTypes if it is not nil.
+func serveRecordingTestSOCKS5(conn net.Conn, addressTypes chan<- byte) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		_ = conn.Close()
+		return
+	}
+	if _, err := io.ReadFull(conn, make([]byte, header[1])); err != nil {
+		_ = conn.Close()
+		return
+	}
+	_, _ = conn.Write([]byte{5, 2})
+	credentials := [2]string{}
+	if _, err := io.ReadFull(conn, make([]byte, 1)); err != nil {
+		_ = conn.Close()
+		return
+	}
+	for i := range credentials {
+		length := make([]byte, 1)
+		value := make([]byte, 0)
+		if _, err := io.ReadFull(conn, length); err == nil {
+			value = make([]byte, length[0])
+			_, _ = io.ReadFull(conn, value)
+		}
+		credentials[i] = string(value)
+	}
+	if credentials[0] != "proxy" || credentials[1] != "proxy" {
+		_, _ = conn.Write([]byte{1, 1})
+		_ = conn.Close()
+		return
+	}
+	_, _ = conn.Write([]byte{1, 0})
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		_ = conn.Close()
+		return
+	}
+	var host string
+	switch request[3] {
+	case 1:
+		address := make([]byte, 4)
+		if _, err := io.ReadFull(conn, address); err != nil {
+			_ = conn.Close()
+			return
+		}
+		host = net.IP(address).String()
+	case 3:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			_ = conn.Close()
+			return
+		}
+		address := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, address); err != nil {
+			_ = conn.Close()
+			return
+		}
+		host = string(address)
+	default:
+		_ = conn.Close()
+		return
+	}
+	if addressTypes != nil {
+		addressTypes <- request[3]
+	}
+	portBytes := make([]byte, 2)
+	if _, err := io.ReadFull(conn, portBytes); err != nil {
+		_ = conn.Close()
+		return
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(portBytes))))
+	backendConn, err := net.Dial("tcp", target)
+	if err != nil {
+		_, _ = conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		_ = conn.Close()
+		return
+	}
+	_, _ = conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+	pipeConnections(conn, backendConn)
+}
+
+// serveTestHTTPConnect is a minimal HTTP CONNECT proxy accepting the username "proxy" with the password "proxy".
+func serveTestHTTPConnect(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	request, err := http.ReadRequest(reader)
+	if err != nil || request.Method != http.MethodConnect {
+		_ = conn.Close()
+		return
+	}
+	if request.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte("proxy:proxy")) {
+		_, _ = conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+		_ = conn.Close()
+		return
+	}
+	backendConn, err := net.Dial("tcp", request.Host)
+	if err != nil {
+		_, _ = conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+		_ = conn.Close()
+		return
+	}
+	_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	pipeConnections(conn, backendConn)
+}
+
+func TestUpstreamProxy(t *testing.T) {
+	backend := startHostKeyTestBackend(t)
+	socks5Address := startTestUpstreamProxy(t, serveTestSOCKS5)
+	httpAddress := startTestUpstreamProxy(t, serveTestHTTPConnect)
+	closedListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen (%v)", err)
+	}
+	closedAddress := closedListener.Addr().String()
+	_ = closedListener.Close()
+
+	for name, testCase := range map[string]struct {
+		proxyURL     string
+		expectedCode string
+	}{
+		"socks5": {
+			proxyURL: "socks5h://proxy:proxy@" + socks5Address,
+		},
+		"socks5-invalid-credentials": {
+			proxyURL:     "socks5h://proxy:invalid@" + socks5Address,
+			expectedCode: sshproxy.EUpstreamProxyFailed,
+		},
+		"http": {
+			proxyURL: "http://proxy:proxy@" + httpAddress,
+		},
+		"http-invalid-credentials": {
+			proxyURL:     "http://proxy:invalid@" + httpAddress,
+			expectedCode: sshproxy.EUpstreamProxyFailed,
+		},
+		"unreachable-proxy": {
+			proxyURL:     "socks5h://proxy:proxy@" + closedAddress,
+			expectedCode: sshproxy.EUpstreamProxyFailed,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			config := backend.config()
+			config.UpstreamProxy = testCase.proxyURL
+			config.Retry.MaxAttempts = 1
+			err := connectHostKeyTestBackend(t, config)
+			if testCase.expectedCode == "" {
+				if err != nil {
+					t.Fatalf("failed to connect backend through upstream proxy (%v)", err)
+				}
+				return
+			}
+			assertErrorCode(t, err, testCase.expectedCode)
+		})
+	}
+
+	t.Run("unreachable-backend", func(t *testing.T) {
+		config := backend.config()
+		config.Server = "127.0.0.1"
+		config.Port = uint16(closedListener.Addr().(*net.TCPAddr).Port)
+		config.UpstreamProxy = "http://proxy:proxy@" + httpAddress
+		config.Retry.MaxAttempts = 1
+		assertErrorCode(t, connectHostKeyTestBackend(t, config), sshproxy.EBackendConnectionFailed)
+	})
+}
+
+func TestUpstreamProxySOCKS5Resolution(t *testing.T) {
+	backend := startHostKeyTestBackend(t)
+	for name, testCase := range map[string]struct {
+		scheme      string
+		addressType byte
+	}{
+		"local": {
+			scheme:      "socks5",
+			addressType: 1,
+		},
+		"remote": {
+			scheme:      "socks5h",
+			addressType: 3,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			addressTypes := make(chan byte, 1)
+			socks5Address := startTestUpstreamProxy(t, func(conn net.Conn) {
+				serveRecordingTestSOCKS5(conn, addressTypes)
+			})
+			config := backend.config()
+			config.Server = "localhost"
+			config.UpstreamProxy = testCase.scheme + "://proxy:proxy@" + socks5Address
+			config.Retry.MaxAttempts = 1
+			if err := connectHostKeyTestBackend(t, config); err != nil {
+				t.Fatalf("failed to connect backend through upstream proxy (%v)", err)
+			}
+			if addressType := <-addressTypes; addressType != testCase.addressType {
+				t.Fatalf("unexpected SOCKS address type: %d, expected: %d", addressType, testCase.addressType)
+			}
+		})
+	}
+}
+
+func TestUpstreamProxyProxyProtocol(t *testing.T) {
+	backend := startHostKeyTestBackend(t)
+	httpAddress := startTestUpstreamProxy(t, serveTestHTTPConnect)
+	address, headers := startProxyProtocolTestListener(t, backend, sshproxy.ProxyProtocolV1)
+	config := backend.config()
+	config.Server = address.IP.String()
+	config.Port = uint16(address.Port)
+	config.UpstreamProxy = "http://proxy:proxy@" + httpAddress
+	config.ProxyProtocol = sshproxy.ProxyProtocolV1
+	config.Retry.MaxAttempts = 1
+	if err := connectHostKeyTestBackend(t, config); err != nil {
+		t.Fatalf("failed to connect backend through upstream proxy (%v)", err)
+	}
+	// The destination is the backend, not the upstream proxy.
+	expected := "PROXY TCP4 127.0.0.1 127.0.0.1 2222 " + strconv.Itoa(address.Port) + "\r\n"
+	if header := <-headers; header.v1 != expected {
+		t.Fatalf("unexpected PROXY protocol v1 header: %q, expected: %q", header.v1, expected)
+	}
+}